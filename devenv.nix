@@ -10,6 +10,7 @@
     golangci-lint
     hello
     nix
+    swtpm
   ];
 
   languages.go.enable = true;
@@ -2,10 +2,12 @@
 package main
 
 import (
+	"os"
+
 	"github.com/MAHDTech/nixos-installer/pkg/installer"
 )
 
 // Run the NixOS Installer.
 func main() {
-	installer.Run()
+	os.Exit(installer.Run())
 }
@@ -3,16 +3,144 @@ package config
 
 import (
 	"errors"
+	"fmt"
 	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
 
 	yaml "gopkg.in/yaml.v3"
 
 	utils "github.com/MAHDTech/nixos-installer/pkg/utils"
 )
 
+// The supported bootloaders.
+const (
+	// BootloaderGRUB uses GRUB with /boot on ZFS and the ESP at /boot/efi.
+	BootloaderGRUB = "grub"
+	// BootloaderSystemdBoot uses systemd-boot with the ESP at /boot.
+	BootloaderSystemdBoot = "systemd-boot"
+	// BootloaderLanzaboote uses the systemd-boot layout, ready for lanzaboote.
+	BootloaderLanzaboote = "lanzaboote"
+)
+
+// Dataset is a ZFS dataset in the pool layout.
+type Dataset struct {
+	// Name is relative to the pool, e.g. var/lib.
+	Name string `yaml:"name" validate:"required"`
+
+	// Mountpoint is where the dataset is mounted on the installed system.
+	Mountpoint string `yaml:"mountpoint" validate:"required"`
+
+	// AutoSnapshot sets com.sun:auto-snapshot, it is inherited when not set.
+	AutoSnapshot *bool `yaml:"autoSnapshot,omitempty"`
+
+	// Shared datasets are kept outside of the boot environment, e.g. home.
+	Shared bool `yaml:"shared" default:"false"`
+
+	// Encrypt makes the dataset an encryption root, or keeps it unencrypted, e.g. nix.
+	// It is inherited from the parent dataset, or the pool encryption, when not set.
+	Encrypt *bool `yaml:"encrypt,omitempty"`
+}
+
+// DatasetEncryption function will return true if the encryption is set per dataset.
+func DatasetEncryption(configData Config) bool {
+	for _, dataset := range configData.ZFS.Datasets {
+		if dataset.Encrypt != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// LocalFlakePath function will return the directory of a local path flake, or "" for a remote flake.
+func LocalFlakePath(flakeURL string) string {
+
+	flakePath := strings.TrimPrefix(flakeURL, "path:")
+	flakePath = strings.TrimPrefix(flakePath, "git+file://")
+	if strings.HasPrefix(flakePath, "/") || strings.HasPrefix(flakePath, ".") {
+		// Drop any query, e.g. ?ref=main.
+		flakePath, _, _ = strings.Cut(flakePath, "?")
+		return flakePath
+	}
+
+	return ""
+
+}
+
+// DefaultDatasets is the dataset layout used when none is configured.
+var DefaultDatasets = []Dataset{
+	{Name: "root", Mountpoint: "/"},
+	{Name: "home", Mountpoint: "/home"},
+	{Name: "nix", Mountpoint: "/nix", AutoSnapshot: boolPointer(false)},
+	{Name: "tmp", Mountpoint: "/tmp", AutoSnapshot: boolPointer(false)},
+	{Name: "var", Mountpoint: "/var"},
+	{Name: "var/lib", Mountpoint: "/var/lib"},
+	{Name: "var/lib/docker", Mountpoint: "/var/lib/docker", AutoSnapshot: boolPointer(false)},
+}
+
+// The supported root filesystems.
+const (
+	// RootFSZFS creates a ZFS pool with a dataset for each entry in the layout.
+	RootFSZFS = "zfs"
+	// RootFSBtrfs creates a btrfs filesystem with a subvolume for each entry in the layout.
+	RootFSBtrfs = "btrfs"
+	// RootFSExt4 creates a single ext4 filesystem.
+	RootFSExt4 = "ext4"
+	// RootFSXFS creates a single XFS filesystem.
+	RootFSXFS = "xfs"
+)
+
+// The supported encryption modes.
+const (
+	// EncryptionZFS uses native ZFS encryption with a passphrase.
+	EncryptionZFS = "zfs"
+	// EncryptionLUKS wraps each pool device in LUKS2 and builds the pool on the opened devices.
+	EncryptionLUKS = "luks"
+)
+
+// The ways an encrypted pool is unlocked on boot.
+const (
+	// UnlockPassphrase prompts for the passphrase.
+	UnlockPassphrase = "passphrase"
+	// UnlockTPM2 unseals the key with the TPM2, the passphrase remains as a fallback.
+	UnlockTPM2 = "tpm2"
+	// UnlockFIDO2 unlocks the LUKS devices with a FIDO2 token.
+	UnlockFIDO2 = "fido2"
+)
+
+// The TPM2 PCRs, separated by '+'.
+var regexPCRs = regexp.MustCompile(`^[0-9]+(\+[0-9]+)*$`)
+
+// What to do when a hook fails.
+const (
+	// HookAbort stops the install and rolls it back.
+	HookAbort = "abort"
+	// HookWarn logs a warning and continues.
+	HookWarn = "warn"
+)
+
+// Hook is a command run at a point in the install.
+type Hook struct {
+	// Command is run with 'sh -c', so it can also be the path to a script.
+	Command string `yaml:"command"`
+
+	// OnFailure is either abort or warn, defaults to abort.
+	OnFailure string `yaml:"onFailure" default:"abort"`
+}
+
+// boolPointer function will return a pointer to the value.
+func boolPointer(value bool) *bool {
+	return &value
+}
+
 // Config is the top-level configuration for the installer.
 type Config struct {
 
+	// MountPoint is where the target is mounted during the install.
+	MountPoint string `yaml:"mountPoint" default:"/mnt/nixos"`
+
 	// NixOS settings
 	NixOS struct {
 		// HostID is optional and will be generated if not specified.
@@ -25,6 +153,12 @@ type Config struct {
 		// This is optional and defaults to disabled.
 		Config struct {
 			Enabled bool `yaml:"enabled" default:"false"`
+
+			// Source is a local path or git URL of the flake to copy onto the partition.
+			Source string `yaml:"source" default:""`
+
+			// Ref is the git branch, tag or commit of the source to check out.
+			Ref string `yaml:"ref" default:""`
 		}
 	} `yaml:"nixos" validate:"required"`
 
@@ -35,6 +169,11 @@ type Config struct {
 		Size  string `yaml:"size" validate:"required"`
 	} `yaml:"uefi" validate:"required"`
 
+	// Bootloader defaults to GRUB.
+	Bootloader struct {
+		Type string `yaml:"type" default:"grub"`
+	} `yaml:"bootloader"`
+
 	// ZFS is required.
 	ZFS struct {
 		Pool struct {
@@ -43,15 +182,136 @@ type Config struct {
 			Encryption  bool   `yaml:"encryption" default:"false"`
 			Mirror      bool   `yaml:"mirror" default:"false"`
 			Stripe      bool   `yaml:"stripe" default:"false"`
+
+			// Compatibility restricts the enabled pool features (e.g. grub2).
+			Compatibility string `yaml:"compatibility" default:""`
+
+			// EncryptionMode is zfs for native encryption or luks for LUKS2 under the pool.
+			EncryptionMode string `yaml:"encryptionMode" default:"zfs"`
+
+			// Unlock is how the encrypted pool is unlocked on boot.
+			Unlock struct {
+				// Method is passphrase, tpm2 or fido2.
+				Method string `yaml:"method" default:"passphrase"`
+
+				// PCRs are the TPM2 PCRs the key is sealed to, e.g. 7 or 0+7.
+				PCRs string `yaml:"pcrs" default:"7"`
+			} `yaml:"unlock"`
 		} `yaml:"pool" validate:"required"`
+
+		// BootPool is a separate GRUB compatible pool for /boot.
+		// This is optional and defaults to disabled.
+		BootPool struct {
+			Enabled bool   `yaml:"enabled" default:"false"`
+			Name    string `yaml:"name" default:"bpool"`
+			Size    string `yaml:"size" default:"2GiB"`
+		} `yaml:"bootPool"`
+
 		Disks []string `yaml:"disks" validate:"required"`
+
+		// DatasetPrefix is prepended to the dataset names, e.g. ROOT/nixos.
+		DatasetPrefix string `yaml:"datasetPrefix" default:""`
+
+		// BootEnvironment installs the datasets that are not shared into ROOT/<name>.
+		// This is optional and defaults to disabled.
+		BootEnvironment string `yaml:"bootEnvironment" default:""`
+
+		// Datasets defaults to DefaultDatasets.
+		Datasets []Dataset `yaml:"datasets"`
+
+		// Impermanence rolls the root dataset back to a blank snapshot on boot.
+		// This is optional and defaults to disabled.
+		Impermanence struct {
+			Enabled     bool `yaml:"enabled" default:"false"`
+			PersistHome bool `yaml:"persistHome" default:"false"`
+		} `yaml:"impermanence"`
 	} `yaml:"zfs" validate:"required"`
 
+	// RootFS selects the root filesystem.
+	// This is optional and defaults to zfs.
+	RootFS struct {
+		// Type is zfs, btrfs, ext4 or xfs.
+		Type string `yaml:"type" default:"zfs"`
+
+		// Disks are used instead of zfs.disks by the other filesystems.
+		// btrfs mirrors the data across several disks, ext4 and xfs use a single disk.
+		Disks []string `yaml:"disks"`
+
+		// Label is the filesystem label.
+		Label string `yaml:"label" default:"nixos"`
+	} `yaml:"rootfs"`
+
 	// Swap defaults to disabled.
 	Swap struct {
 		Enabled bool   `yaml:"enabled" default:"false"`
 		Size    string `yaml:"size" validate:"required"`
 	} `yaml:"swap" validate:"required"`
+
+	// Install settings for nixos-install.
+	// This is optional and is only used with the install flag.
+	Install struct {
+		// Args are extra arguments, e.g. --max-jobs 8.
+		Args []string `yaml:"args"`
+
+		// Env is the environment of nixos-install, defaults to NIXPKGS_ALLOW_UNFREE=1.
+		Env map[string]string `yaml:"env"`
+
+		// RootPassword is hashed before being set, use RootHashedPassword to avoid a plain text password.
+		RootPassword       string `yaml:"rootPassword" default:""`
+		RootHashedPassword string `yaml:"rootHashedPassword" default:""`
+
+		// SSHKeys are added to the authorized keys of root.
+		SSHKeys []string `yaml:"sshKeys"`
+
+		// System is a prebuilt system closure to install instead of the flake, for offline installs.
+		System string `yaml:"system" default:""`
+
+		// Cache is a local binary cache to substitute from, e.g. file:///mnt/cache.
+		Cache string `yaml:"cache" default:""`
+
+		// CacheKey is the public key the cache is signed with, e.g. cache:AbC...=.
+		CacheKey string `yaml:"cacheKey" default:""`
+
+		// Prebuild builds the system into the live store before any disks are wiped.
+		Prebuild bool `yaml:"prebuild" default:"false"`
+	} `yaml:"install"`
+
+	// Secrets provisions the keys used by sops-nix and agenix onto the target.
+	// This is optional and defaults to disabled.
+	Secrets struct {
+		Enabled bool `yaml:"enabled" default:"false"`
+
+		// SSHHostKeys is a directory of existing host keys to copy, new keys are generated when empty.
+		SSHHostKeys string `yaml:"sshHostKeys" default:""`
+
+		// SSHHostKeysPath is where the host keys are written on the target.
+		// Defaults to /etc/ssh, or /persist/etc/ssh with impermanence.
+		SSHHostKeysPath string `yaml:"sshHostKeysPath" default:""`
+
+		// AgeKey is an age key for sops-nix.
+		AgeKey struct {
+			Enabled bool `yaml:"enabled" default:"false"`
+
+			// Source is an existing key file to copy, a new key is generated when empty.
+			Source string `yaml:"source" default:""`
+
+			// Path is where the key is written on the target.
+			// Defaults to /var/lib/sops-nix/key.txt, under /persist with impermanence.
+			Path string `yaml:"path" default:""`
+		} `yaml:"ageKey"`
+
+		// Wait pauses before nixos-install so the secrets can be re-encrypted for the new keys.
+		Wait bool `yaml:"wait" default:"false"`
+	} `yaml:"secrets"`
+
+	// Hooks are commands run at points in the install.
+	// This is optional and defaults to no hooks.
+	Hooks struct {
+		PrePartition       []Hook `yaml:"prePartition"`
+		PostMount          []Hook `yaml:"postMount"`
+		PostGenerateConfig []Hook `yaml:"postGenerateConfig"`
+		PostInstall        []Hook `yaml:"postInstall"`
+	} `yaml:"hooks"`
 }
 
 // ReadConfig reads the configuration file.
@@ -87,18 +347,248 @@ func ReadConfig(configFile string) (Config, error) {
 
 // ValidateConfig validates the configuration file.
 func validateConfig(configData *Config) error {
-	// Make sure a flake was specified.
-	if configData.NixOS.Flake == "" {
+	// Make sure a flake was specified, a prebuilt system doesn't need one.
+	if configData.NixOS.Flake == "" && configData.Install.System == "" {
 		return errors.New("flake not specified")
 	}
+	if configData.NixOS.Flake != "" && !strings.Contains(configData.NixOS.Flake, "#") {
+		return fmt.Errorf("flake %s must be in the form <flake>#<host>", configData.NixOS.Flake)
+	}
+
+	// The flake source is copied onto the NixOS config partition.
+	if configData.NixOS.Config.Source != "" && !configData.NixOS.Config.Enabled {
+		return errors.New("nixos.config.source requires nixos.config.enabled")
+	}
+	if configData.NixOS.Config.Ref != "" && configData.NixOS.Config.Source == "" {
+		return errors.New("nixos.config.ref requires nixos.config.source")
+	}
+
+	// The host ID is generated when it is empty.
+	configData.NixOS.HostID = strings.ToLower(strings.TrimSpace(configData.NixOS.HostID))
+	if configData.NixOS.HostID != "" && !ValidHostID(configData.NixOS.HostID) {
+		return fmt.Errorf("invalid nixos.hostId %q, it must be 8 hexadecimal digits and not zero", configData.NixOS.HostID)
+	}
+
+	// Default to GRUB which matches the original layout.
+	switch configData.Bootloader.Type {
+	case "":
+		configData.Bootloader.Type = BootloaderGRUB
+	case BootloaderGRUB, BootloaderSystemdBoot, BootloaderLanzaboote:
+	default:
+		return fmt.Errorf("invalid bootloader type: %s", configData.Bootloader.Type)
+	}
+
+	// The boot pool holds /boot which only GRUB reads from ZFS.
+	if configData.ZFS.BootPool.Enabled {
+		if configData.Bootloader.Type != BootloaderGRUB {
+			return errors.New("boot pool requires the grub bootloader")
+		}
+		if configData.ZFS.BootPool.Name == "" {
+			configData.ZFS.BootPool.Name = "bpool"
+		}
+		if configData.ZFS.BootPool.Size == "" {
+			configData.ZFS.BootPool.Size = "2GiB"
+		}
+		if configData.ZFS.BootPool.Name == configData.ZFS.Pool.Name {
+			return errors.New("boot pool and pool names must be different")
+		}
+	}
+
+	// Default to native ZFS encryption.
+	switch configData.ZFS.Pool.EncryptionMode {
+	case "":
+		configData.ZFS.Pool.EncryptionMode = EncryptionZFS
+	case EncryptionZFS, EncryptionLUKS:
+	default:
+		return fmt.Errorf("invalid encryption mode: %s", configData.ZFS.Pool.EncryptionMode)
+	}
+
+	// Only native ZFS encryption has encryption roots below the pool.
+	if DatasetEncryption(*configData) && configData.ZFS.Pool.Encryption && configData.ZFS.Pool.EncryptionMode != EncryptionZFS {
+		return errors.New("per dataset encryption requires the zfs encryption mode")
+	}
+
+	// Default to typing the passphrase on boot.
+	switch configData.ZFS.Pool.Unlock.Method {
+	case "":
+		configData.ZFS.Pool.Unlock.Method = UnlockPassphrase
+	case UnlockPassphrase:
+	case UnlockTPM2, UnlockFIDO2:
+		if !configData.ZFS.Pool.Encryption {
+			return fmt.Errorf("%s unlock requires pool encryption", configData.ZFS.Pool.Unlock.Method)
+		}
+		// A FIDO2 token is enrolled with systemd-cryptenroll which only supports LUKS.
+		if configData.ZFS.Pool.Unlock.Method == UnlockFIDO2 && configData.ZFS.Pool.EncryptionMode != EncryptionLUKS {
+			return errors.New("fido2 unlock requires the luks encryption mode")
+		}
+	default:
+		return fmt.Errorf("invalid unlock method: %s", configData.ZFS.Pool.Unlock.Method)
+	}
+	if configData.ZFS.Pool.Unlock.PCRs == "" {
+		configData.ZFS.Pool.Unlock.PCRs = "7"
+	}
+	if !regexPCRs.MatchString(configData.ZFS.Pool.Unlock.PCRs) {
+		return errors.New("invalid TPM2 PCRs: " + configData.ZFS.Pool.Unlock.PCRs)
+	}
+
+	// Default to the original mount point.
+	if configData.MountPoint == "" {
+		configData.MountPoint = "/mnt/nixos"
+	}
+	if !path.IsAbs(configData.MountPoint) || path.Clean(configData.MountPoint) == "/" {
+		return errors.New("invalid mount point: " + configData.MountPoint)
+	}
+	configData.MountPoint = path.Clean(configData.MountPoint)
+
+	// The dataset prefix is relative to the pool.
+	configData.ZFS.DatasetPrefix = strings.Trim(configData.ZFS.DatasetPrefix, "/")
+
+	// The boot environment is a single dataset under ROOT.
+	if strings.Contains(configData.ZFS.BootEnvironment, "/") {
+		return errors.New("invalid boot environment name: " + configData.ZFS.BootEnvironment)
+	}
+
+	// Default to the original dataset layout.
+	if len(configData.ZFS.Datasets) == 0 {
+		configData.ZFS.Datasets = append([]Dataset{}, DefaultDatasets...)
+	}
+
+	// Impermanence needs somewhere to persist state.
+	if configData.ZFS.Impermanence.Enabled {
+		configData.ZFS.Datasets = appendDataset(
+			configData.ZFS.Datasets,
+			Dataset{Name: "persist", Mountpoint: "/persist"},
+		)
+		if configData.ZFS.Impermanence.PersistHome {
+			configData.ZFS.Datasets = appendDataset(
+				configData.ZFS.Datasets,
+				Dataset{Name: "persist/home", Mountpoint: "/persist/home"},
+			)
+		}
+	}
+
+	// Validate the dataset layout.
+	err := validateDatasets(configData.ZFS.Datasets)
+	if err != nil {
+		return err
+	}
+
+	// Default to allowing unfree packages as the manual install always has.
+	if configData.Install.Env == nil {
+		configData.Install.Env = map[string]string{"NIXPKGS_ALLOW_UNFREE": "1"}
+	}
+	if configData.Install.RootPassword != "" && configData.Install.RootHashedPassword != "" {
+		return errors.New("install.rootPassword and install.rootHashedPassword can't both be set")
+	}
+	if configData.Install.RootHashedPassword != "" && !strings.HasPrefix(configData.Install.RootHashedPassword, "$") {
+		return errors.New("install.rootHashedPassword must be a crypt hash, e.g. from 'mkpasswd -m sha-512'")
+	}
+	// The root dataset is rolled back on every boot, which would lose the password and keys written to it.
+	rootLogin := configData.Install.RootPassword != "" || configData.Install.RootHashedPassword != "" || len(configData.Install.SSHKeys) > 0
+	if rootLogin && configData.ZFS.Impermanence.Enabled {
+		return errors.New("install.rootPassword, install.rootHashedPassword and install.sshKeys can't be used with impermanence, " +
+			"set users.users.root.hashedPassword and users.users.root.openssh.authorizedKeys.keys in the flake instead")
+	}
+
+	// The secrets are written to /persist when the root is rolled back.
+	if configData.Secrets.Enabled {
+		persist := ""
+		if configData.ZFS.Impermanence.Enabled {
+			persist = "/persist"
+		}
+		if configData.Secrets.SSHHostKeysPath == "" {
+			configData.Secrets.SSHHostKeysPath = persist + "/etc/ssh"
+		}
+		if configData.Secrets.AgeKey.Path == "" {
+			configData.Secrets.AgeKey.Path = persist + "/var/lib/sops-nix/key.txt"
+		}
+		if !path.IsAbs(configData.Secrets.SSHHostKeysPath) || !path.IsAbs(configData.Secrets.AgeKey.Path) {
+			return errors.New("secrets.sshHostKeysPath and secrets.ageKey.path must be absolute")
+		}
+		if configData.Secrets.SSHHostKeys != "" && !utils.FileExists(configData.Secrets.SSHHostKeys) {
+			return errors.New("secrets.sshHostKeys not found: " + configData.Secrets.SSHHostKeys)
+		}
+		if configData.Secrets.AgeKey.Source != "" && !utils.FileExists(configData.Secrets.AgeKey.Source) {
+			return errors.New("secrets.ageKey.source not found: " + configData.Secrets.AgeKey.Source)
+		}
+		if configData.Secrets.Wait && configData.Install.Prebuild {
+			return errors.New("secrets.wait can't be used with install.prebuild, the system is built before the secrets are re-encrypted")
+		}
+	}
+
+	// Validate the hooks.
+	for _, hooks := range [][]Hook{
+		configData.Hooks.PrePartition,
+		configData.Hooks.PostMount,
+		configData.Hooks.PostGenerateConfig,
+		configData.Hooks.PostInstall,
+	} {
+		for i := range hooks {
+			if hooks[i].Command == "" {
+				return errors.New("hook command not specified")
+			}
+			switch hooks[i].OnFailure {
+			case "":
+				hooks[i].OnFailure = HookAbort
+			case HookAbort, HookWarn:
+			default:
+				return fmt.Errorf("invalid hook onFailure: %s", hooks[i].OnFailure)
+			}
+		}
+	}
+
+	// The offline install sources.
+	if configData.Install.System != "" && !strings.HasPrefix(configData.Install.System, "/nix/store/") {
+		return fmt.Errorf("install.system %s must be a path in /nix/store", configData.Install.System)
+	}
+	if configData.Install.Prebuild && configData.Install.System != "" {
+		return errors.New("install.prebuild can't be used with a prebuilt install.system")
+	}
+	if strings.HasPrefix(configData.Install.Cache, "/") {
+		configData.Install.Cache = "file://" + configData.Install.Cache
+	}
+	if configData.Install.CacheKey != "" && configData.Install.Cache == "" {
+		return errors.New("install.cacheKey requires install.cache")
+	}
+	if configData.NixOS.Config.Source != "" && configData.NixOS.Flake == "" {
+		return errors.New("nixos.config.source requires nixos.flake for the host")
+	}
+
+	// Building from the cache alone must not fetch the flake from the network.
+	if configData.Install.Cache != "" && configData.Install.System == "" {
+		flakeURL, _, _ := strings.Cut(configData.NixOS.Flake, "#")
+		if configData.NixOS.Config.Source != "" {
+			flakeURL = configData.NixOS.Config.Source
+		}
+		if LocalFlakePath(flakeURL) == "" {
+			return fmt.Errorf("install.cache without install.system requires a local path flake, %s would be fetched from the network", flakeURL)
+		}
+	}
 
 	// Check if the UEFI target device is a valid block device.
 	if !utils.IsValidBlockDevice(configData.UEFI.Disk) {
 		return errors.New("Invalid block device: " + configData.UEFI.Disk)
 	}
 
+	// Default to the original ZFS layout.
+	switch configData.RootFS.Type {
+	case "":
+		configData.RootFS.Type = RootFSZFS
+	case RootFSZFS:
+	case RootFSBtrfs, RootFSExt4, RootFSXFS:
+		err := validateRootFS(configData)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid rootfs type: %s", configData.RootFS.Type)
+	}
+	if configData.RootFS.Label == "" {
+		configData.RootFS.Label = "nixos"
+	}
+
 	// Check if the root disks are valid block devices.
-	for _, rootDisk := range configData.ZFS.Disks {
+	for _, rootDisk := range RootDisks(*configData) {
 		if !utils.IsValidBlockDevice(rootDisk) {
 			return errors.New("Invalid block device: " + rootDisk)
 		}
@@ -119,3 +609,115 @@ func validateConfig(configData *Config) error {
 	return nil
 
 }
+
+// RootDisks function will return the disks holding the root filesystem.
+func RootDisks(configData Config) []string {
+	if configData.RootFS.Type == RootFSZFS || configData.RootFS.Type == "" {
+		return configData.ZFS.Disks
+	}
+	return configData.RootFS.Disks
+}
+
+// validateRootFS function will validate the settings of a root filesystem other than ZFS.
+func validateRootFS(configData *Config) error {
+
+	if len(configData.RootFS.Disks) == 0 {
+		return fmt.Errorf("rootfs.disks must be set for %s", configData.RootFS.Type)
+	}
+	if len(configData.RootFS.Disks) > 1 && configData.RootFS.Type != RootFSBtrfs {
+		return fmt.Errorf("%s only supports a single disk", configData.RootFS.Type)
+	}
+
+	// These rely on ZFS pools and datasets.
+	switch {
+	case configData.ZFS.Pool.Encryption || DatasetEncryption(*configData):
+		return fmt.Errorf("encryption requires the zfs root filesystem, not %s", configData.RootFS.Type)
+	case configData.ZFS.BootPool.Enabled:
+		return fmt.Errorf("the boot pool requires the zfs root filesystem, not %s", configData.RootFS.Type)
+	case configData.ZFS.Impermanence.Enabled:
+		return fmt.Errorf("impermanence requires the zfs root filesystem, not %s", configData.RootFS.Type)
+	case configData.ZFS.BootEnvironment != "":
+		return fmt.Errorf("boot environments require the zfs root filesystem, not %s", configData.RootFS.Type)
+	}
+
+	// The swap file is sized in MiB.
+	if configData.Swap.Enabled {
+		_, err := SizeMiB(configData.Swap.Size)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+}
+
+// SizeMiB function will convert a size such as 8GiB, 8G or 512M to MiB.
+func SizeMiB(size string) (int, error) {
+
+	units := map[string]int{"M": 1, "G": 1024, "T": 1024 * 1024}
+
+	value := strings.TrimSuffix(strings.TrimSuffix(strings.TrimSpace(size), "B"), "i")
+	if value == "" {
+		return 0, errors.New("invalid size: " + size)
+	}
+	multiplier, ok := units[strings.ToUpper(value[len(value)-1:])]
+	if !ok {
+		return 0, errors.New("invalid size, it must end in M, G or T: " + size)
+	}
+	number, err := strconv.Atoi(value[:len(value)-1])
+	if err != nil || number <= 0 {
+		return 0, errors.New("invalid size: " + size)
+	}
+
+	return number * multiplier, nil
+
+}
+
+// appendDataset function will add the dataset unless the mountpoint is already used.
+func appendDataset(datasets []Dataset, dataset Dataset) []Dataset {
+	for _, existing := range datasets {
+		if existing.Mountpoint == dataset.Mountpoint {
+			return datasets
+		}
+	}
+	return append(datasets, dataset)
+}
+
+// validateDatasets function will validate the dataset layout.
+func validateDatasets(datasets []Dataset) error {
+
+	names := map[string]bool{}
+	mountpoints := map[string]bool{}
+
+	for _, dataset := range datasets {
+		if strings.Trim(dataset.Name, "/") == "" || strings.HasPrefix(dataset.Name, "/") {
+			return errors.New("invalid dataset name: " + dataset.Name)
+		}
+		if !strings.HasPrefix(dataset.Mountpoint, "/") {
+			return fmt.Errorf("dataset %s mountpoint must be absolute: %s", dataset.Name, dataset.Mountpoint)
+		}
+		if dataset.Mountpoint == "/" && dataset.Shared {
+			return errors.New("the dataset mounted at / can't be shared: " + dataset.Name)
+		}
+		if dataset.Mountpoint == "/boot" {
+			return errors.New("/boot is managed by the bootloader, remove dataset: " + dataset.Name)
+		}
+		if names[dataset.Name] {
+			return errors.New("duplicate dataset: " + dataset.Name)
+		}
+		if mountpoints[dataset.Mountpoint] {
+			return errors.New("duplicate dataset mountpoint: " + dataset.Mountpoint)
+		}
+		names[dataset.Name] = true
+		mountpoints[dataset.Mountpoint] = true
+	}
+
+	// The root filesystem must be a dataset.
+	if !mountpoints["/"] {
+		return errors.New("no dataset is mounted at /")
+	}
+
+	return nil
+
+}
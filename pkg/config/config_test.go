@@ -0,0 +1,28 @@
+package config
+
+import "testing"
+
+func TestLocalFlakePath(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		flakeURL string
+		want     string
+	}{
+		{name: "absolute path", flakeURL: "/mnt/nix-config", want: "/mnt/nix-config"},
+		{name: "relative path", flakeURL: "./nix-config", want: "./nix-config"},
+		{name: "path scheme", flakeURL: "path:/mnt/nix-config", want: "/mnt/nix-config"},
+		{name: "git file", flakeURL: "git+file:///mnt/nix-config?ref=main", want: "/mnt/nix-config"},
+		{name: "github", flakeURL: "github:MAHDTech/nix-config", want: ""},
+		{name: "git https", flakeURL: "git+https://github.com/MAHDTech/nix-config.git", want: ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := LocalFlakePath(test.flakeURL); got != test.want {
+				t.Errorf("LocalFlakePath(%q) = %q, want %q", test.flakeURL, got, test.want)
+			}
+		})
+	}
+
+}
@@ -0,0 +1,108 @@
+// Package config provides the configuration for the installer.
+// This file provides the NixOS host ID.
+package config
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// A host ID is 32 bits written as 8 hexadecimal digits.
+var regexHostID = regexp.MustCompile(`^[0-9a-f]{8}$`)
+
+// The hostId setting in the nixos section of the YAML.
+var regexHostIDLine = regexp.MustCompile(`(?m)^([ \t]+)hostId:.*$`)
+var regexNixOSSection = regexp.MustCompile(`(?m)^nixos:[ \t]*(#.*)?\n`)
+
+// The next top level key, which ends the nixos section.
+var regexTopLevelKey = regexp.MustCompile(`(?m)^[^\s#]`)
+
+// ValidHostID function will return true if the host ID is 8 hexadecimal digits and not zero.
+func ValidHostID(hostID string) bool {
+	return regexHostID.MatchString(hostID) && hostID != "00000000"
+}
+
+// ReadHostID function will return the host ID of a hostid file, e.g. /etc/hostid.
+// The file holds the 32 bit host ID in the byte order of the machine.
+func ReadHostID(hostIDFile string) (string, error) {
+
+	// #nosec G304
+	value, err := os.ReadFile(hostIDFile)
+	if err != nil {
+		return "", err
+	}
+	if len(value) != 4 {
+		return "", fmt.Errorf("%s is %d bytes instead of 4", hostIDFile, len(value))
+	}
+
+	hostID := fmt.Sprintf("%08x", binary.NativeEndian.Uint32(value))
+	if !ValidHostID(hostID) {
+		return "", fmt.Errorf("%s holds the invalid host ID %s", hostIDFile, hostID)
+	}
+
+	return hostID, nil
+
+}
+
+// GenerateHostID function will return a random host ID.
+func GenerateHostID() (string, error) {
+
+	for {
+		value := make([]byte, 4)
+		_, err := rand.Read(value)
+		if err != nil {
+			return "", err
+		}
+		hostID := hex.EncodeToString(value)
+		if ValidHostID(hostID) {
+			return hostID, nil
+		}
+	}
+
+}
+
+// SaveHostID function will write the host ID back into the configuration file.
+// Only the hostId line is changed so the comments and layout are kept.
+func SaveHostID(configFile string, hostID string) error {
+
+	// #nosec G304
+	yamlFile, err := os.ReadFile(configFile)
+	if err != nil {
+		return err
+	}
+	content := string(yamlFile)
+	setting := "hostId: \"" + hostID + "\""
+
+	section := regexNixOSSection.FindStringIndex(content)
+	if section == nil {
+		content = strings.TrimRight(content, "\n") + "\nnixos:\n  " + setting + "\n"
+	} else {
+		// Only the hostId in the nixos section is changed, it ends at the next top level key.
+		start := section[1]
+		end := len(content)
+		if next := regexTopLevelKey.FindStringIndex(content[start:]); next != nil {
+			end = start + next[0]
+		}
+		if location := regexHostIDLine.FindStringSubmatchIndex(content[start:end]); location != nil {
+			// Replace the existing setting.
+			indent := content[start+location[2] : start+location[3]]
+			content = content[:start+location[0]] + indent + setting + content[start+location[1]:]
+		} else {
+			// Add the setting at the top of the nixos section.
+			content = content[:start] + "  " + setting + "\n" + content[start:]
+		}
+	}
+
+	info, err := os.Stat(configFile)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(configFile, []byte(content), info.Mode().Perm())
+
+}
@@ -0,0 +1,154 @@
+package config
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidHostID(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		hostID string
+		want   bool
+	}{
+		{name: "valid", hostID: "def10001", want: true},
+		{name: "zero", hostID: "00000000", want: false},
+		{name: "uppercase", hostID: "DEF10001", want: false},
+		{name: "short", hostID: "def1000", want: false},
+		{name: "long", hostID: "def100011", want: false},
+		{name: "not hex", hostID: "def1000g", want: false},
+		{name: "empty", hostID: "", want: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := ValidHostID(test.hostID); got != test.want {
+				t.Errorf("ValidHostID(%q) = %v, want %v", test.hostID, got, test.want)
+			}
+		})
+	}
+
+}
+
+func TestGenerateHostID(t *testing.T) {
+
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		hostID, err := GenerateHostID()
+		if err != nil {
+			t.Fatalf("GenerateHostID() error = %v", err)
+		}
+		if !ValidHostID(hostID) {
+			t.Errorf("GenerateHostID() = %q, not a valid host ID", hostID)
+		}
+		seen[hostID] = true
+	}
+	if len(seen) < 90 {
+		t.Errorf("GenerateHostID() returned %d different host IDs out of 100", len(seen))
+	}
+
+}
+
+func TestReadHostID(t *testing.T) {
+
+	valid := make([]byte, 4)
+	binary.NativeEndian.PutUint32(valid, 0xdef10001)
+
+	tests := []struct {
+		name    string
+		content []byte
+		want    string
+		wantErr bool
+	}{
+		{name: "valid", content: valid, want: "def10001"},
+		{name: "zero", content: []byte{0, 0, 0, 0}, wantErr: true},
+		{name: "short", content: []byte{1, 2, 3}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hostIDFile := filepath.Join(t.TempDir(), "hostid")
+			if err := os.WriteFile(hostIDFile, test.content, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := ReadHostID(hostIDFile)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("ReadHostID() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("ReadHostID() = %q, want %q", got, test.want)
+			}
+		})
+	}
+
+}
+
+func TestSaveHostID(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{
+			name:    "replace empty",
+			content: "nixos:\n  hostId: \"\"\n  flake: x#y\n",
+			want:    "nixos:\n  hostId: \"def10001\"\n  flake: x#y\n",
+		},
+		{
+			name:    "keep comments",
+			content: "# Settings\nnixos:\n  # The host ID.\n  hostId: \"\" # blank\n  flake: x#y\n",
+			want:    "# Settings\nnixos:\n  # The host ID.\n  hostId: \"def10001\"\n  flake: x#y\n",
+		},
+		{
+			name:    "add to section",
+			content: "nixos:\n  flake: x#y\nswap:\n  enabled: false\n",
+			want:    "nixos:\n  hostId: \"def10001\"\n  flake: x#y\nswap:\n  enabled: false\n",
+		},
+		{
+			name:    "add section",
+			content: "swap:\n  enabled: false\n",
+			want:    "swap:\n  enabled: false\nnixos:\n  hostId: \"def10001\"\n",
+		},
+		{
+			name:    "only the nixos section",
+			content: "other:\n  hostId: keep\nnixos:\n  flake: x#y\nlater:\n  hostId: keep\n",
+			want:    "other:\n  hostId: keep\nnixos:\n  hostId: \"def10001\"\n  flake: x#y\nlater:\n  hostId: keep\n",
+		},
+		{
+			name:    "replace in the nixos section",
+			content: "other:\n  hostId: keep\nnixos:\n  hostId: \"\"\n",
+			want:    "other:\n  hostId: keep\nnixos:\n  hostId: \"def10001\"\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			configFile := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(configFile, []byte(test.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if err := SaveHostID(configFile, "def10001"); err != nil {
+				t.Fatalf("SaveHostID() error = %v", err)
+			}
+			got, err := os.ReadFile(configFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != test.want {
+				t.Errorf("SaveHostID() wrote\n%s\nwant\n%s", got, test.want)
+			}
+			info, err := os.Stat(configFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode().Perm() != 0o600 {
+				t.Errorf("SaveHostID() changed the mode to %v", info.Mode().Perm())
+			}
+		})
+	}
+
+}
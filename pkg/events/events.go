@@ -0,0 +1,196 @@
+// Package events provides machine-readable progress events for driving the installer.
+// Events are written as JSON lines to a file, an inherited file descriptor or a Unix socket.
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The types of event.
+const (
+	TypeStepStarted    = "step_started"
+	TypeStepFinished   = "step_finished"
+	TypeCommandOutput  = "command_output"
+	TypeError          = "error"
+	TypePromptRequired = "prompt_required"
+)
+
+// Event is a single progress event.
+type Event struct {
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	Step    string    `json:"step,omitempty"`
+	Message string    `json:"message,omitempty"`
+	Command []string  `json:"command,omitempty"`
+	Stream  string    `json:"stream,omitempty"`
+}
+
+// The destination of the events and the current step.
+var (
+	mu     sync.Mutex
+	writer io.WriteCloser
+	step   string
+)
+
+// Open function will start writing events to the target.
+// The target is either fd:<number>, unix:<socket path> or a file path.
+func Open(target string) error {
+
+	var (
+		destination io.WriteCloser
+		err         error
+	)
+
+	switch {
+	case strings.HasPrefix(target, "fd:"):
+		fd, convErr := strconv.Atoi(strings.TrimPrefix(target, "fd:"))
+		if convErr != nil || fd < 0 {
+			return errors.New("invalid events file descriptor: " + target)
+		}
+		destination = os.NewFile(uintptr(fd), target)
+	case strings.HasPrefix(target, "unix:"):
+		destination, err = net.Dial("unix", strings.TrimPrefix(target, "unix:"))
+	default:
+		// #nosec G304
+		destination, err = os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	}
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	writer = destination
+
+	return nil
+
+}
+
+// Enabled function will return true if events are being written.
+func Enabled() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return writer != nil
+}
+
+// Close function will stop writing events.
+func Close() {
+	mu.Lock()
+	defer mu.Unlock()
+	if writer != nil {
+		_ = writer.Close()
+		writer = nil
+	}
+}
+
+// Emit function will write the event, filling in the time and current step.
+func Emit(event Event) {
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if writer == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	if event.Step == "" {
+		event.Step = step
+	}
+
+	line, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	// A consumer that went away must not stop the install.
+	_, _ = writer.Write(append(line, '\n'))
+
+}
+
+// StepStarted function will emit the start of a step and make it the current step.
+func StepStarted(name string) {
+	mu.Lock()
+	step = name
+	mu.Unlock()
+	Emit(Event{Type: TypeStepStarted, Step: name})
+}
+
+// StepFinished function will emit the end of a step.
+func StepFinished(name string) {
+	Emit(Event{Type: TypeStepFinished, Step: name})
+	mu.Lock()
+	if step == name {
+		step = ""
+	}
+	mu.Unlock()
+}
+
+// Error function will emit an error.
+func Error(message string) {
+	Emit(Event{Type: TypeError, Message: message})
+}
+
+// PromptRequired function will emit that the next command waits for input on the console.
+func PromptRequired(message string) {
+	Emit(Event{Type: TypePromptRequired, Message: message})
+}
+
+// OutputWriter function will return a writer that emits each line as command output.
+func OutputWriter(command []string, stream string) *LineWriter {
+	return &LineWriter{command: command, stream: stream}
+}
+
+// LineWriter emits command output one line at a time.
+type LineWriter struct {
+	command []string
+	stream  string
+	buffer  bytes.Buffer
+}
+
+// Write function will emit every complete line and keep the remainder.
+func (writer *LineWriter) Write(data []byte) (int, error) {
+
+	writer.buffer.Write(data)
+	for {
+		line, err := writer.buffer.ReadString('\n')
+		if err != nil {
+			// Keep the partial line for the next write.
+			writer.buffer.Reset()
+			writer.buffer.WriteString(line)
+			break
+		}
+		Emit(Event{
+			Type:    TypeCommandOutput,
+			Message: strings.TrimRight(line, "\r\n"),
+			Command: writer.command,
+			Stream:  writer.stream,
+		})
+	}
+
+	return len(data), nil
+
+}
+
+// Flush function will emit the remaining partial line, if any.
+func (writer *LineWriter) Flush() {
+	if writer.buffer.Len() == 0 {
+		return
+	}
+	Emit(Event{
+		Type:    TypeCommandOutput,
+		Message: strings.TrimRight(writer.buffer.String(), "\r\n"),
+		Command: writer.command,
+		Stream:  writer.stream,
+	})
+	writer.buffer.Reset()
+}
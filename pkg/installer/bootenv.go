@@ -0,0 +1,49 @@
+// Package installer contains the logic for installing NixOS.
+// This file contains the logic for boot environments.
+package installer
+
+import (
+	"path"
+
+	config "github.com/MAHDTech/nixos-installer/pkg/config"
+	logger "github.com/MAHDTech/nixos-installer/pkg/logger"
+)
+
+// bootEnvironmentPath function will return the root dataset of the boot environment.
+func bootEnvironmentPath(configData config.Config) string {
+	return path.Join(configData.ZFS.Pool.Name, "ROOT", configData.ZFS.BootEnvironment)
+}
+
+// prepareBootEnvironment function will import the existing pools for a new boot environment.
+// It returns the datasets that already exist so they are kept rather than created.
+func prepareBootEnvironment(execute bool, configData config.Config, datasets []zfsDataset) map[string]bool {
+
+	if configData.ZFS.BootEnvironment == "" {
+		logger.Fatal("zfs.bootEnvironment must be set to add a boot environment")
+	}
+
+	// The disks and pools are kept, only the pools are imported.
+	logger.Info("Skipping disk preparation and pool creation for the boot environment.")
+	importPools(execute, configData)
+
+	existing := existingDatasets(datasets)
+
+	// Never install over an existing boot environment.
+	zfsDatasetPathRoot := bootEnvironmentPath(configData)
+	if existing[zfsDatasetPathRoot] {
+		logger.Panicf("Boot environment %s already exists, choose another name.\n", zfsDatasetPathRoot)
+	}
+
+	// Only the shared datasets and their containers may already exist.
+	for _, dataset := range datasets {
+		if existing[dataset.Path] && dataset.mounted() && !dataset.Shared {
+			logger.Panicf("Dataset %s already exists but is not shared.\n", dataset.Path)
+		}
+		if existing[dataset.Path] {
+			logger.Infof("Keeping existing dataset %s.\n", dataset.Path)
+		}
+	}
+
+	return existing
+
+}
@@ -0,0 +1,242 @@
+// Package installer contains the logic for installing NixOS.
+// This file contains the logic for the btrfs root filesystem.
+package installer
+
+import (
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	config "github.com/MAHDTech/nixos-installer/pkg/config"
+	logger "github.com/MAHDTech/nixos-installer/pkg/logger"
+	utils "github.com/MAHDTech/nixos-installer/pkg/utils"
+)
+
+// The subvolume holding the swap file, it is kept out of the snapshots.
+const btrfsSubvolumeSwap = "swap"
+
+// The directory in the top level holding the install snapshots.
+const btrfsSubvolumeSnapshots = "snapshots"
+
+// The mount options of the subvolumes.
+var btrfsMountOptions = []string{"compress=zstd", "noatime"}
+
+// btrfsFilesystem is a btrfs filesystem with a subvolume for each entry in the layout.
+type btrfsFilesystem struct {
+	// subvolumes are named after the datasets, e.g. var/lib.
+	subvolumes []volume
+}
+
+// btrfsTopLevel function will return where the top level of the filesystem is mounted to manage the subvolumes.
+func btrfsTopLevel() string {
+	return path.Join(os.TempDir(), "nixos-installer-btrfs")
+}
+
+// btrfsSubvolumes function will return the subvolumes, named after the datasets.
+func btrfsSubvolumes(configData config.Config) []volume {
+
+	subvolumes := []volume{}
+	swap := configData.Swap.Enabled
+	for _, dataset := range configData.ZFS.Datasets {
+		subvolumes = append(subvolumes, volume{
+			Path:       path.Join(configData.ZFS.DatasetPrefix, dataset.Name),
+			Mountpoint: dataset.Mountpoint,
+		})
+		if dataset.Mountpoint == "/"+btrfsSubvolumeSwap {
+			swap = false
+		}
+	}
+
+	// The swap file needs a subvolume without snapshots or compression.
+	if swap {
+		subvolumes = append(subvolumes, volume{
+			Path:       btrfsSubvolumeSwap,
+			Mountpoint: "/" + btrfsSubvolumeSwap,
+		})
+	}
+
+	return subvolumes
+
+}
+
+// create function will wipe the disks and create the filesystem, mirrored across several disks.
+func (fs *btrfsFilesystem) create(execute bool, configData config.Config, mountpointsJSON []byte) {
+
+	partitionRootDisks(execute, configData, mountpointsJSON)
+
+	args := []string{"-f", "-L", configData.RootFS.Label}
+	if len(config.RootDisks(configData)) > 1 {
+		logger.Info("Creating mirrored btrfs filesystem.")
+		args = append(args, "-d", "raid1", "-m", "raid1")
+	}
+	args = append(args, rootPartitions(configData)...)
+
+	logger.Infof("Formatting btrfs partitions: %v\n", rootPartitions(configData))
+	utils.Execute(
+		execute,
+		"mkfs.btrfs",
+		args...,
+	)
+
+}
+
+// mountTopLevel function will mount the top level of the filesystem to manage the subvolumes.
+func (fs *btrfsFilesystem) mountTopLevel(execute bool, configData config.Config) {
+
+	logger.Infof("Mounting the btrfs top level to %s.\n", btrfsTopLevel())
+	utils.Execute(
+		execute,
+		"mount",
+		"-o",
+		"X-mount.mkdir,subvolid=5",
+		"-t",
+		"btrfs",
+		rootPartitions(configData)[0],
+		btrfsTopLevel(),
+	)
+	registerUndo("Unmount "+btrfsTopLevel(), "umount", btrfsTopLevel())
+
+}
+
+// unmountTopLevel function will unmount the top level of the filesystem.
+func (fs *btrfsFilesystem) unmountTopLevel(execute bool) {
+
+	logger.Infof("Unmounting the btrfs top level from %s.\n", btrfsTopLevel())
+	utils.Execute(
+		execute,
+		"umount",
+		btrfsTopLevel(),
+	)
+	dropUndo("Unmount " + btrfsTopLevel())
+
+}
+
+// layout function will return the subvolumes.
+func (fs *btrfsFilesystem) layout() []volume {
+	return fs.subvolumes
+}
+
+// createVolumes function will create the subvolumes with parents before children.
+func (fs *btrfsFilesystem) createVolumes(execute bool, configData config.Config) {
+
+	logger.Info("Creating btrfs subvolumes.")
+	fs.mountTopLevel(execute, configData)
+
+	for _, subvolume := range volumeCreateOrder(fs.subvolumes) {
+		subvolumePath := path.Join(btrfsTopLevel(), subvolume.Path)
+
+		// Missing parents are plain directories, e.g. var in var/lib.
+		utils.Execute(
+			execute,
+			"mkdir",
+			"-p",
+			path.Dir(subvolumePath),
+		)
+
+		logger.Infof("Creating subvolume %s for %s\n", subvolume.Path, subvolume.Mountpoint)
+		utils.Execute(
+			execute,
+			"btrfs",
+			"subvolume",
+			"create",
+			subvolumePath,
+		)
+	}
+
+	fs.unmountTopLevel(execute)
+
+}
+
+// open function will do nothing as the filesystem is mounted directly.
+func (fs *btrfsFilesystem) open(execute bool, configData config.Config) {}
+
+// mount function will mount the subvolumes with parents before children.
+func (fs *btrfsFilesystem) mount(execute bool, configData config.Config) {
+
+	for _, subvolume := range volumeMountOrder(fs.subvolumes) {
+		mountPointSubvolume := path.Join(configData.MountPoint, subvolume.Mountpoint)
+		options := "X-mount.mkdir,subvol=" + subvolume.Path
+		for _, option := range fs.mountOptions(subvolume) {
+			options += "," + option
+		}
+		logger.Infof("Mounting subvolume %s to %s.\n", subvolume.Path, mountPointSubvolume)
+		utils.Execute(
+			execute,
+			"mount",
+			"-o",
+			options,
+			"-t",
+			"btrfs",
+			rootPartitions(configData)[0],
+			mountPointSubvolume,
+		)
+		registerUndo("Unmount "+mountPointSubvolume, "umount", mountPointSubvolume)
+	}
+
+}
+
+// mountOptions function will return the mount options of a subvolume, the swap file can't be compressed.
+func (fs *btrfsFilesystem) mountOptions(subvolume volume) []string {
+	if subvolume.Path == btrfsSubvolumeSwap {
+		return []string{"noatime"}
+	}
+	return btrfsMountOptions
+}
+
+// settings function will return the mount options and the swap file.
+// nixos-generate-config finds the subvolumes but not their options.
+func (fs *btrfsFilesystem) settings(configData config.Config) []string {
+
+	settings := []string{}
+	for _, subvolume := range fs.subvolumes {
+		quoted := ""
+		for _, option := range fs.mountOptions(subvolume) {
+			quoted += "\"" + option + "\" "
+		}
+		settings = append(settings, "fileSystems.\""+subvolume.Mountpoint+"\".options = [ "+quoted+"];")
+	}
+
+	return append(settings, swapFileSettings(configData, path.Join("/", btrfsSubvolumeSwap, "swapfile"))...)
+
+}
+
+// snapshot function will take read-only snapshots of the subvolumes in the top level.
+func (fs *btrfsFilesystem) snapshot(execute bool, configData config.Config) {
+
+	fs.mountTopLevel(execute, configData)
+
+	snapshotsPath := path.Join(btrfsTopLevel(), btrfsSubvolumeSnapshots, "install-"+time.Now().UTC().Format("20060102-150405"))
+	utils.Execute(
+		execute,
+		"mkdir",
+		"-p",
+		snapshotsPath,
+	)
+
+	// The snapshots are flat, a snapshot of var already holds the empty lib directory of var/lib and is read-only.
+	for _, subvolume := range volumeCreateOrder(fs.subvolumes) {
+		if subvolume.Path == btrfsSubvolumeSwap {
+			continue
+		}
+		snapshotPath := path.Join(snapshotsPath, strings.ReplaceAll(subvolume.Path, "/", "-"))
+		logger.Infof("Creating install snapshot: %s\n", snapshotPath)
+		utils.Execute(
+			execute,
+			"btrfs",
+			"subvolume",
+			"snapshot",
+			"-r",
+			path.Join(btrfsTopLevel(), subvolume.Path),
+			snapshotPath,
+		)
+	}
+
+	fs.unmountTopLevel(execute)
+
+}
+
+// release function will do nothing as unmounting releases the filesystem.
+func (fs *btrfsFilesystem) release(execute bool, configData config.Config) bool {
+	return true
+}
@@ -0,0 +1,205 @@
+// Package installer contains the logic for installing NixOS.
+// This file contains the logic for the ZFS dataset layout.
+package installer
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	config "github.com/MAHDTech/nixos-installer/pkg/config"
+)
+
+// The user property read by zfs-auto-snapshot and sanoid.
+const zfsPropertyAutoSnapshot = "com.sun:auto-snapshot"
+
+// zfsDataset is a ZFS dataset that is created and mounted on the target.
+// The volume path is the full dataset path including the pool.
+// Containers that only hold other datasets are not mounted.
+type zfsDataset struct {
+	volume
+
+	// Properties are set when the dataset is created, e.g. atime=off.
+	Properties []string
+
+	// Shared is true when the dataset is outside of the boot environment.
+	Shared bool
+
+	// Encrypted is true when the encryption is set per dataset and the dataset is encrypted.
+	Encrypted bool
+
+	// EncryptionRoot is true when the dataset is encrypted and its parent is not.
+	EncryptionRoot bool
+}
+
+// zfsDatasets function will return the dataset layout for the configuration.
+func zfsDatasets(configData config.Config) []zfsDataset {
+
+	datasets := []zfsDataset{}
+	encrypt := map[string]*bool{}
+
+	// The boot dataset only exists when the bootloader can read ZFS.
+	if bootOnZFS(configData) {
+		zfsDatasetPathBoot := path.Join(zfsBootPoolName(configData), configData.ZFS.DatasetPrefix, zfsDatasetBoot)
+		if configData.ZFS.BootEnvironment != "" {
+			zfsDatasetPathBoot = path.Join(zfsBootPoolName(configData), "BOOT", configData.ZFS.BootEnvironment)
+		}
+		datasets = append(datasets, zfsDataset{
+			volume:     volume{Path: zfsDatasetPathBoot, Mountpoint: "/boot"},
+			Properties: []string{"mountpoint=legacy"},
+		})
+	}
+
+	for _, dataset := range configData.ZFS.Datasets {
+
+		properties := []string{"mountpoint=legacy"}
+
+		// Tell the snapshot tools on the installed system what to snapshot.
+		if dataset.AutoSnapshot != nil {
+			properties = append(properties, zfsPropertyAutoSnapshot+"="+strconv.FormatBool(*dataset.AutoSnapshot))
+		}
+
+		// The boot environment holds the root and the datasets that are not shared.
+		zfsDatasetPath := path.Join(configData.ZFS.Pool.Name, configData.ZFS.DatasetPrefix, dataset.Name)
+		if configData.ZFS.BootEnvironment != "" && !dataset.Shared {
+			zfsDatasetPath = bootEnvironmentPath(configData)
+			if dataset.Mountpoint != "/" {
+				zfsDatasetPath = path.Join(zfsDatasetPath, dataset.Name)
+			}
+		}
+
+		datasets = append(datasets, zfsDataset{
+			volume:     volume{Path: zfsDatasetPath, Mountpoint: dataset.Mountpoint},
+			Properties: properties,
+			Shared:     dataset.Shared,
+		})
+		encrypt[zfsDatasetPath] = dataset.Encrypt
+	}
+
+	datasets = append(datasets, containerDatasets(datasets)...)
+
+	if config.DatasetEncryption(configData) {
+		datasets = datasetEncryption(configData, datasets, encrypt)
+	}
+
+	return datasets
+
+}
+
+// containerDatasets function will return the missing parents of the datasets.
+// For example ROOT is needed to hold ROOT/nixos.
+func containerDatasets(datasets []zfsDataset) []zfsDataset {
+
+	exists := map[string]bool{}
+	for _, dataset := range datasets {
+		exists[dataset.Path] = true
+	}
+
+	containers := []zfsDataset{}
+	for _, dataset := range datasets {
+		// Walk up to, but not including, the pool.
+		for parent := path.Dir(dataset.Path); strings.Contains(parent, "/"); parent = path.Dir(parent) {
+			if exists[parent] {
+				continue
+			}
+			exists[parent] = true
+			containers = append(containers, zfsDataset{
+				volume:     volume{Path: parent},
+				Properties: []string{"canmount=off", "mountpoint=none"},
+			})
+		}
+	}
+
+	return containers
+
+}
+
+// datasetEncryption function will mark the encrypted datasets and their encryption roots.
+// A dataset inherits the encryption of its configured parent, a top level dataset the pool encryption.
+// Containers are never encrypted so the datasets below them can choose.
+func datasetEncryption(configData config.Config, datasets []zfsDataset, encrypt map[string]*bool) []zfsDataset {
+
+	// Parents are decided before their children.
+	encrypted := map[string]bool{}
+	for _, dataset := range datasetCreateOrder(datasets) {
+		configured, ok := encrypt[dataset.Path]
+		if !ok || datasetPool(dataset) != configData.ZFS.Pool.Name {
+			continue
+		}
+		_, parentConfigured := encrypt[path.Dir(dataset.Path)]
+		switch {
+		case configured != nil:
+			encrypted[dataset.Path] = *configured
+		case parentConfigured:
+			encrypted[dataset.Path] = encrypted[path.Dir(dataset.Path)]
+		default:
+			encrypted[dataset.Path] = configData.ZFS.Pool.Encryption
+		}
+	}
+
+	for i, dataset := range datasets {
+		datasets[i].Encrypted = encrypted[dataset.Path]
+		datasets[i].EncryptionRoot = encrypted[dataset.Path] && !encrypted[path.Dir(dataset.Path)]
+	}
+
+	return datasets
+
+}
+
+// checkDatasetEncryption function will check no unencrypted dataset is below an encrypted one.
+func checkDatasetEncryption(datasets []zfsDataset) error {
+
+	encrypted := map[string]bool{}
+	for _, dataset := range datasets {
+		encrypted[dataset.Path] = dataset.Encrypted
+	}
+	for _, dataset := range datasets {
+		parent := path.Dir(dataset.Path)
+		if !dataset.Encrypted && encrypted[parent] {
+			return fmt.Errorf("dataset %s can't be unencrypted below the encrypted dataset %s", dataset.Path, parent)
+		}
+	}
+
+	return nil
+
+}
+
+// rootDataset function will return the dataset mounted at /.
+func rootDataset(datasets []zfsDataset) zfsDataset {
+	for _, dataset := range datasets {
+		if dataset.Mountpoint == "/" {
+			return dataset
+		}
+	}
+	return zfsDataset{}
+}
+
+// datasetCreateOrder function will return the datasets with parents before children.
+func datasetCreateOrder(datasets []zfsDataset) []zfsDataset {
+
+	ordered := append([]zfsDataset{}, datasets...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return strings.Count(ordered[i].Path, "/") < strings.Count(ordered[j].Path, "/")
+	})
+
+	return ordered
+
+}
+
+// createArgs function will return the zfs arguments to create the dataset.
+// The encryption arguments are only added to an encryption root, the other datasets inherit them.
+func (dataset zfsDataset) createArgs(encryption []string) []string {
+
+	args := []string{"create"}
+	for _, property := range dataset.Properties {
+		args = append(args, "-o", property)
+	}
+	if dataset.EncryptionRoot {
+		args = append(args, encryption...)
+	}
+
+	return append(args, dataset.Path)
+
+}
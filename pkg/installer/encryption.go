@@ -0,0 +1,96 @@
+// Package installer contains the logic for installing NixOS.
+// This file contains the logic for the native ZFS encryption roots.
+package installer
+
+import (
+	"path"
+
+	config "github.com/MAHDTech/nixos-installer/pkg/config"
+	logger "github.com/MAHDTech/nixos-installer/pkg/logger"
+	utils "github.com/MAHDTech/nixos-installer/pkg/utils"
+)
+
+// zfsPoolEncrypted function will return true if the root of the pool is the encryption root.
+// With the encryption set per dataset, the pool is not encrypted and the datasets are the encryption roots.
+func zfsPoolEncrypted(configData config.Config) bool {
+	return zfsNativeEncryption(configData) && !config.DatasetEncryption(configData)
+}
+
+// swapEncrypted function will return true if the swap volume is its own encryption root.
+func swapEncrypted(configData config.Config) bool {
+	return configData.Swap.Enabled && zfsNativeEncryption(configData) && config.DatasetEncryption(configData)
+}
+
+// zfsEncryptionArgs function will return the encryption properties of an encryption root.
+// The flag is -O for a pool and -o for a dataset.
+func zfsEncryptionArgs(configData config.Config, flag string, sealed bool) []string {
+
+	args := []string{flag, "encryption=aes-256-gcm"}
+
+	// A key sealed to the TPM2 is generated instead of prompting for a passphrase.
+	if sealed {
+		return append(args,
+			flag, "keyformat=hex",
+			flag, "keylocation=file://"+zfsKeyFile(configData),
+		)
+	}
+
+	return append(args,
+		flag, "keyformat=passphrase",
+		flag, "keylocation=prompt",
+	)
+
+}
+
+// encryptionRoots function will return the encryption roots of the pool.
+func encryptionRoots(configData config.Config, datasets []zfsDataset) []string {
+
+	roots := []string{}
+	if zfsPoolEncrypted(configData) {
+		return append(roots, configData.ZFS.Pool.Name)
+	}
+
+	for _, dataset := range datasetCreateOrder(datasets) {
+		if dataset.EncryptionRoot {
+			roots = append(roots, dataset.Path)
+		}
+	}
+	if swapEncrypted(configData) {
+		roots = append(roots, path.Join(configData.ZFS.Pool.Name, zfsDatasetSwap))
+	}
+
+	return roots
+
+}
+
+// promptKeyLocation function will prompt for the key of an encryption root created with the sealed key.
+// The temporary key file is gone after a reboot, so the recovery key is typed when the TPM2 can't unseal it.
+func promptKeyLocation(execute bool, encryptionRoot string) {
+
+	logger.Infof("Setting the key location of %s to prompt.\n", encryptionRoot)
+	utils.Execute(
+		execute,
+		"zfs",
+		"set",
+		"keylocation=prompt",
+		encryptionRoot,
+	)
+
+}
+
+// encryptionSettings function will return the settings to unlock the encryption roots of the datasets on boot.
+func encryptionSettings(configData config.Config, datasets []zfsDataset) []string {
+
+	roots := encryptionRoots(configData, datasets)
+	if len(roots) == 0 {
+		return []string{}
+	}
+
+	quoted := ""
+	for _, root := range roots {
+		quoted += "\"" + root + "\" "
+	}
+
+	return []string{"boot.zfs.requestEncryptionCredentials = [ " + quoted + "];"}
+
+}
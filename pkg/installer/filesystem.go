@@ -0,0 +1,274 @@
+// Package installer contains the logic for installing NixOS.
+// This file contains the logic for the root filesystem backends.
+package installer
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	config "github.com/MAHDTech/nixos-installer/pkg/config"
+	logger "github.com/MAHDTech/nixos-installer/pkg/logger"
+	utils "github.com/MAHDTech/nixos-installer/pkg/utils"
+	validate "github.com/MAHDTech/nixos-installer/pkg/validate"
+)
+
+// volume is a filesystem of the layout mounted on the target, e.g. a ZFS dataset or a btrfs subvolume.
+type volume struct {
+	// Path identifies the volume, the dataset, the subvolume or the partition.
+	Path string
+
+	// Mountpoint is where the volume is mounted on the installed system.
+	// Volumes that only hold other volumes are not mounted.
+	Mountpoint string
+}
+
+// mounted function will return true if the volume is mounted on the target.
+func (v volume) mounted() bool {
+	return v.Mountpoint != ""
+}
+
+// filesystem is a root filesystem backend, selected by rootfs.type.
+// Each backend maps the layout in the configuration to its own volumes.
+type filesystem interface {
+	// layout returns the volumes that are created and mounted.
+	layout() []volume
+
+	// create wipes the root disks and creates the filesystem.
+	create(execute bool, configData config.Config, mountpointsJSON []byte)
+
+	// createVolumes creates the volumes of the layout and the swap.
+	createVolumes(execute bool, configData config.Config)
+
+	// open makes an existing install ready to mount, e.g. imports the pools.
+	open(execute bool, configData config.Config)
+
+	// mount mounts the volumes of the layout under the mountpoint.
+	mount(execute bool, configData config.Config)
+
+	// settings returns the NixOS settings for the filesystem.
+	settings(configData config.Config) []string
+
+	// snapshot snapshots the freshly installed system.
+	snapshot(execute bool, configData config.Config)
+
+	// release is the last step of the teardown once the target is unmounted.
+	// It returns false if anything was left behind.
+	release(execute bool, configData config.Config) bool
+}
+
+// newFilesystem function will return the backend for the configured root filesystem.
+func newFilesystem(configData config.Config, bootEnv bool) filesystem {
+	switch configData.RootFS.Type {
+	case config.RootFSBtrfs:
+		return &btrfsFilesystem{subvolumes: btrfsSubvolumes(configData)}
+	case config.RootFSExt4, config.RootFSXFS:
+		return &plainFilesystem{root: volume{Path: rootPartitions(configData)[0], Mountpoint: "/"}}
+	default:
+		return &zfsFilesystem{bootEnv: bootEnv, existing: map[string]bool{}, datasets: zfsDatasets(configData)}
+	}
+}
+
+// volumeCreateOrder function will return the volumes with parents before children.
+func volumeCreateOrder(volumes []volume) []volume {
+
+	ordered := append([]volume{}, volumes...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return strings.Count(ordered[i].Path, "/") < strings.Count(ordered[j].Path, "/")
+	})
+
+	return ordered
+
+}
+
+// volumeMountOrder function will return the volumes in the order they must be mounted.
+func volumeMountOrder(volumes []volume) []volume {
+
+	ordered := append([]volume{}, volumes...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return mountDepth(ordered[i].Mountpoint) < mountDepth(ordered[j].Mountpoint)
+	})
+
+	return ordered
+
+}
+
+// mountDepth function will return how deep a mountpoint is, with / being 0.
+func mountDepth(mountpoint string) int {
+	mountpoint = strings.Trim(path.Clean(mountpoint), "/")
+	if mountpoint == "" {
+		return 0
+	}
+	return strings.Count(mountpoint, "/") + 1
+}
+
+// rootPartitions function will return the partition holding the root filesystem on each disk.
+func rootPartitions(configData config.Config) []string {
+
+	partitions := []string{}
+	for _, disk := range config.RootDisks(configData) {
+		partitions = append(partitions, partitionName(disk, 1))
+	}
+
+	return partitions
+
+}
+
+// partitionRootDisks function will wipe the root disks and create a single partition on each.
+func partitionRootDisks(execute bool, configData config.Config, mountpointsJSON []byte) {
+
+	for _, disk := range config.RootDisks(configData) {
+
+		// Determine if and where the disk is currently mounted.
+		mountpointsDisk, err := utils.GetMountpoints(disk, mountpointsJSON)
+		if err != nil {
+			validate.Panic(err)
+		}
+
+		// Unmount all mountpoints for the disk.
+		err = utils.UnmountAll(execute, mountpointsDisk)
+		if err != nil {
+			validate.Panic(err)
+		}
+
+		// Zap the root disk.
+		logger.Infof("Zapping %s.\n", disk)
+		utils.Execute(
+			execute,
+			"sgdisk",
+			"--zap-all",
+			disk,
+		)
+		recordChange("%s was wiped for the %s root filesystem.", disk, configData.RootFS.Type)
+
+		// Create a single partition for the root filesystem.
+		logger.Infof("Creating %s partition on %s.\n", configData.RootFS.Type, disk)
+		utils.Execute(
+			execute,
+			"parted",
+			"--script",
+			"--fix",
+			"--align",
+			"optimal",
+			disk,
+			"--",
+			"mklabel",
+			"gpt",
+			"mkpart",
+			configData.RootFS.Label,
+			configData.RootFS.Type,
+			"1MiB",
+			"100%",
+		)
+	}
+
+	// Run partprobe to update the partition table.
+	logger.Info("Running partprobe to update the partition table.")
+	utils.ExecuteSilent(
+		execute,
+		"partprobe",
+	)
+
+	// Sleep a few seconds to allow the partition table to update.
+	if execute {
+		logger.Info("Waiting...")
+		time.Sleep(5 * time.Second)
+	}
+
+}
+
+// swapFileSettings function will return the settings for a swap file, NixOS creates it on boot.
+func swapFileSettings(configData config.Config, swapFile string) []string {
+
+	if !configData.Swap.Enabled {
+		return []string{}
+	}
+
+	// The size was checked when the configuration was read.
+	size, _ := config.SizeMiB(configData.Swap.Size)
+
+	return []string{fmt.Sprintf("swapDevices = [ { device = \"%s\"; size = %d; } ];", swapFile, size)}
+
+}
+
+// plainFilesystem is a single ext4 or XFS filesystem holding the whole layout.
+type plainFilesystem struct {
+	// root is the root partition, the other datasets are directories on it.
+	root volume
+}
+
+// layout function will return the root partition.
+func (fs *plainFilesystem) layout() []volume {
+	return []volume{fs.root}
+}
+
+// create function will wipe the disk and format the root partition.
+func (fs *plainFilesystem) create(execute bool, configData config.Config, mountpointsJSON []byte) {
+
+	partitionRootDisks(execute, configData, mountpointsJSON)
+
+	logger.Infof("Formatting %s partition: %s\n", configData.RootFS.Type, fs.root.Path)
+	if configData.RootFS.Type == config.RootFSXFS {
+		utils.Execute(
+			execute,
+			"mkfs.xfs",
+			"-f",
+			"-L",
+			configData.RootFS.Label,
+			fs.root.Path,
+		)
+	} else {
+		utils.Execute(
+			execute,
+			"mkfs.ext4",
+			"-F",
+			"-L",
+			configData.RootFS.Label,
+			fs.root.Path,
+		)
+	}
+
+}
+
+// createVolumes function will do nothing as the layout is a single filesystem.
+func (fs *plainFilesystem) createVolumes(execute bool, configData config.Config) {
+	logger.Infof("Skipping dataset creation as %s is a single filesystem.\n", configData.RootFS.Type)
+}
+
+// open function will do nothing as the filesystem is mounted directly.
+func (fs *plainFilesystem) open(execute bool, configData config.Config) {}
+
+// mount function will mount the root partition.
+func (fs *plainFilesystem) mount(execute bool, configData config.Config) {
+
+	logger.Infof("Mounting %s to %s.\n", fs.root.Path, configData.MountPoint)
+	utils.Execute(
+		execute,
+		"mount",
+		"-o",
+		"X-mount.mkdir",
+		"-t",
+		configData.RootFS.Type,
+		fs.root.Path,
+		configData.MountPoint,
+	)
+	registerUndo("Unmount "+configData.MountPoint, "umount", configData.MountPoint)
+
+}
+
+// settings function will return the swap file, nixos-generate-config finds the filesystem.
+func (fs *plainFilesystem) settings(configData config.Config) []string {
+	return swapFileSettings(configData, "/swapfile")
+}
+
+// snapshot function will do nothing as ext4 and XFS have no snapshots.
+func (fs *plainFilesystem) snapshot(execute bool, configData config.Config) {
+	logger.Infof("Skipping install snapshots as %s has no snapshots.\n", configData.RootFS.Type)
+}
+
+// release function will do nothing as unmounting releases the filesystem.
+func (fs *plainFilesystem) release(execute bool, configData config.Config) bool {
+	return true
+}
@@ -0,0 +1,333 @@
+// Package installer contains the logic for installing NixOS.
+// This file contains the logic for checking the flake.
+package installer
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	config "github.com/MAHDTech/nixos-installer/pkg/config"
+	logger "github.com/MAHDTech/nixos-installer/pkg/logger"
+	utils "github.com/MAHDTech/nixos-installer/pkg/utils"
+)
+
+// The nix features needed for flakes, which may not be enabled on the live ISO.
+var nixFlakeArgs = []string{"--extra-experimental-features", "nix-command flakes"}
+
+// parseFlake function will split a flake reference into the flake and the host.
+func parseFlake(flake string) (string, string, error) {
+
+	flakeURL, host, found := strings.Cut(flake, "#")
+	if !found || flakeURL == "" || host == "" {
+		return "", "", fmt.Errorf("flake %s must be in the form <flake>#<host>", flake)
+	}
+
+	return flakeURL, host, nil
+
+}
+
+// preflightFlake function will return the flake to check and build before the disks are wiped.
+// With a flake source, the source is used as the copy doesn't exist yet.
+func preflightFlake(configData config.Config) string {
+
+	if configData.NixOS.Config.Source == "" {
+		return configData.NixOS.Flake
+	}
+
+	_, host, _ := parseFlake(configData.NixOS.Flake)
+
+	return sourceFlakeURL(configData) + "#" + host
+
+}
+
+// checkFlake function will fetch the flake and evaluate the host before anything is wiped.
+// With a cache, the inputs of the flake are substituted from the cache so no network is needed.
+// It returns the derivation of the system.
+func checkFlake(configData config.Config) (string, error) {
+
+	flakeURL, host, err := parseFlake(preflightFlake(configData))
+	if err != nil {
+		return "", err
+	}
+	args := append([]string{}, nixFlakeArgs...)
+	if configData.Install.Cache != "" {
+		args = append(args, cacheArgs(configData)...)
+	}
+
+	// A local flake can be used for testing without the network.
+	if flakePath := config.LocalFlakePath(flakeURL); flakePath != "" {
+		if !utils.FileExists(path.Join(flakePath, "flake.nix")) {
+			return "", fmt.Errorf("local flake %s does not contain a flake.nix", flakePath)
+		}
+	}
+
+	// Fetch the flake and its inputs.
+	logger.Infof("Fetching flake %s\n", flakeURL)
+	_, err = utils.Query(
+		"nix",
+		append(args,
+			"flake",
+			"metadata",
+			flakeURL,
+		)...,
+	)
+	if err != nil {
+		return "", fmt.Errorf("unable to fetch flake %s: %w", flakeURL, err)
+	}
+
+	// Evaluate the system for the host, this fails if the host does not exist.
+	attribute := fmt.Sprintf("%s#nixosConfigurations.\"%s\".config.system.build.toplevel.drvPath", flakeURL, host)
+	logger.Infof("Evaluating NixOS configuration %s\n", host)
+	drvPath, err := utils.Query(
+		"nix",
+		append(args,
+			"eval",
+			"--impure",
+			"--raw",
+			attribute,
+		)...,
+	)
+	if err != nil {
+		return "", fmt.Errorf("unable to evaluate host %s in flake %s: %w", host, flakeURL, err)
+	}
+
+	return strings.TrimSpace(drvPath), nil
+
+}
+
+// The git commit of a full hash, anything else is treated as a branch or tag.
+var regexCommit = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// sourceFlakeURL function will return the flake reference of the configured flake source.
+func sourceFlakeURL(configData config.Config) string {
+
+	source := configData.NixOS.Config.Source
+	ref := configData.NixOS.Config.Ref
+
+	if config.LocalFlakePath(source) != "" {
+		return source
+	}
+
+	if !strings.HasPrefix(source, "git+") {
+		source = "git+" + source
+	}
+	switch {
+	case ref == "":
+	case regexCommit.MatchString(ref):
+		source += "?rev=" + ref
+	default:
+		source += "?ref=" + ref
+	}
+
+	return source
+
+}
+
+// copyFlakeSource function will copy or clone the flake source onto the NixOS config partition.
+// It returns the flake reference pointing at the copy.
+func copyFlakeSource(execute bool, configData config.Config) string {
+
+	source := configData.NixOS.Config.Source
+	ref := configData.NixOS.Config.Ref
+	mountPointNixOSConfig := path.Join(configData.MountPoint, "boot/nixos")
+
+	if config.LocalFlakePath(source) != "" {
+		logger.Infof("Copying flake %s to %s\n", source, mountPointNixOSConfig)
+		utils.Execute(
+			execute,
+			"cp",
+			"-a",
+			config.LocalFlakePath(source)+"/.",
+			mountPointNixOSConfig,
+		)
+	} else {
+		logger.Infof("Cloning flake %s to %s\n", source, mountPointNixOSConfig)
+		utils.Execute(
+			execute,
+			"git",
+			"clone",
+			strings.TrimPrefix(source, "git+"),
+			mountPointNixOSConfig,
+		)
+	}
+
+	// Check out the requested branch, tag or commit.
+	if ref != "" {
+		logger.Infof("Checking out %s\n", ref)
+		utils.Execute(
+			execute,
+			"git",
+			"-C",
+			mountPointNixOSConfig,
+			"checkout",
+			ref,
+		)
+	}
+
+	// Record the commit that is installed.
+	commitPath := mountPointNixOSConfig
+	if !execute {
+		// A dry run can only check a local source that is used as is.
+		commitPath = ""
+		if ref == "" {
+			commitPath = config.LocalFlakePath(source)
+		}
+	}
+	if commitPath != "" {
+		commit, err := utils.Query("git", "-C", commitPath, "rev-parse", "HEAD")
+		if err != nil {
+			logger.Warnf("Unable to determine the commit of the flake, it may not be a git repository: %s\n", err)
+		} else {
+			logger.Infof("Installing flake commit %s\n", strings.TrimSpace(commit))
+		}
+	}
+
+	// Install from the copy with the host from the configured flake.
+	_, host, _ := parseFlake(configData.NixOS.Flake)
+
+	return mountPointNixOSConfig + "#" + host
+
+}
+
+// refreshFlakeSource function will update the copy of the flake source on the NixOS config partition.
+func refreshFlakeSource(execute bool, configData config.Config) {
+
+	source := configData.NixOS.Config.Source
+	ref := configData.NixOS.Config.Ref
+	mountPointNixOSConfig := path.Join(configData.MountPoint, "boot/nixos")
+
+	if config.LocalFlakePath(source) != "" {
+		logger.Infof("Copying flake %s to %s again\n", source, mountPointNixOSConfig)
+		utils.Execute(
+			execute,
+			"cp",
+			"-a",
+			config.LocalFlakePath(source)+"/.",
+			mountPointNixOSConfig,
+		)
+		return
+	}
+	if regexCommit.MatchString(ref) {
+		logger.Warnf("The flake source is pinned to commit %s, the re-encrypted secrets are not fetched.\n", ref)
+		return
+	}
+
+	// Fetch the branches and re-resolve the tags, a checked out tag is a detached HEAD that can't be pulled.
+	logger.Infof("Fetching flake %s into %s\n", source, mountPointNixOSConfig)
+	utils.Execute(
+		execute,
+		"git",
+		"-C",
+		mountPointNixOSConfig,
+		"fetch",
+		"--force",
+		"--tags",
+		"origin",
+	)
+
+	// Without a ref the default branch of the clone is checked out.
+	checkout := []string{"-C", mountPointNixOSConfig, "checkout"}
+	switch {
+	case ref == "":
+		checkout = append(checkout, "--detach", "origin/HEAD")
+	case flakeSourceTag(execute, mountPointNixOSConfig, ref):
+		checkout = append(checkout, "--detach", "refs/tags/"+ref)
+	default:
+		checkout = append(checkout, "-B", ref, "origin/"+ref)
+	}
+	logger.Infof("Checking out %s again\n", checkout[len(checkout)-1])
+	utils.Execute(
+		execute,
+		"git",
+		checkout...,
+	)
+
+	if execute {
+		commit, err := utils.Query("git", "-C", mountPointNixOSConfig, "rev-parse", "HEAD")
+		if err == nil {
+			logger.Infof("Installing flake commit %s\n", strings.TrimSpace(commit))
+		}
+	}
+
+}
+
+// flakeSourceTag function will return true if the ref of the flake source is a tag.
+// A dry run has no clone to check, the ref is treated as a branch.
+func flakeSourceTag(execute bool, flakePath string, ref string) bool {
+
+	if !execute {
+		return false
+	}
+
+	_, err := utils.Query("git", "-C", flakePath, "show-ref", "--verify", "--quiet", "refs/tags/"+ref)
+
+	return err == nil
+
+}
+
+// refreshFlake function will fetch the flake again, bypassing the cache of the preflight fetch.
+// nixos-install reuses a cached fetch that is younger than the tarball-ttl.
+func refreshFlake(execute bool, configData config.Config) {
+
+	flakeURL, _, _ := parseFlake(configData.NixOS.Flake)
+	args := append([]string{}, nixFlakeArgs...)
+	if configData.Install.Cache != "" {
+		args = append(args, cacheArgs(configData)...)
+	}
+	logger.Infof("Fetching flake %s again\n", flakeURL)
+	utils.Execute(
+		execute,
+		"nix",
+		append(args,
+			"flake",
+			"metadata",
+			"--refresh",
+			flakeURL,
+		)...,
+	)
+
+}
+
+// The link that keeps the prebuilt system from being garbage collected during the install.
+const prebuildOutLink = "/tmp/nixos-installer-system"
+
+// prebuildSystem function will build the system into the live store.
+// It returns the store path of the system, which is empty in a dry run.
+func prebuildSystem(execute bool, configData config.Config) string {
+
+	flakeURL, host, _ := parseFlake(preflightFlake(configData))
+	attribute := fmt.Sprintf("%s#nixosConfigurations.\"%s\".config.system.build.toplevel", flakeURL, host)
+
+	// Build with the same environment as nixos-install.
+	args := append(installEnv(configData), "nix")
+	args = append(args, nixFlakeArgs...)
+	args = append(args,
+		"build",
+		"--impure",
+		"--print-out-paths",
+		"--out-link",
+		prebuildOutLink,
+	)
+	if configData.Install.Cache != "" {
+		args = append(args, cacheArgs(configData)...)
+	}
+	args = append(args, attribute)
+
+	logger.Infof("Building NixOS configuration %s before making any changes\n", host)
+	system := strings.TrimSpace(utils.ExecuteStdOut(
+		execute,
+		"env",
+		args...,
+	))
+
+	if execute {
+		logger.Infof("Built system %s, it is copied to the target by nixos-install\n", system)
+	} else {
+		logger.Info("DRY RUN: The built system would be installed with 'nixos-install --system'")
+	}
+
+	return system
+
+}
@@ -0,0 +1,95 @@
+// Package installer contains the logic for installing NixOS.
+// This file contains the logic for running the hooks.
+package installer
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	config "github.com/MAHDTech/nixos-installer/pkg/config"
+	logger "github.com/MAHDTech/nixos-installer/pkg/logger"
+	utils "github.com/MAHDTech/nixos-installer/pkg/utils"
+	validate "github.com/MAHDTech/nixos-installer/pkg/validate"
+)
+
+// The points in the install where hooks are run, also used as the step names.
+const (
+	hookPrePartition       = "pre-partition"
+	hookPostMount          = "post-mount"
+	hookPostGenerateConfig = "post-generate-config"
+	hookPostInstall        = "post-install"
+)
+
+// hookDataset is a dataset in the DATASETS environment variable.
+type hookDataset struct {
+	Path       string `json:"path"`
+	Mountpoint string `json:"mountpoint"`
+}
+
+// hookEnv function will return the environment variables describing the layout.
+func hookEnv(configData config.Config, hook string, datasets []volume) []string {
+
+	hookDatasets := []hookDataset{}
+	for _, dataset := range volumeMountOrder(datasets) {
+		if !dataset.mounted() {
+			continue
+		}
+		hookDatasets = append(hookDatasets, hookDataset{Path: dataset.Path, Mountpoint: dataset.Mountpoint})
+	}
+	datasetsJSON, err := json.Marshal(hookDatasets)
+	validate.Panic(err)
+
+	return []string{
+		"HOOK=" + hook,
+		"MOUNT_ROOT=" + configData.MountPoint,
+		"POOL=" + configData.ZFS.Pool.Name,
+		"BOOT_POOL=" + zfsBootPoolName(configData),
+		"ESP_DEVICE=" + partitionName(configData.UEFI.Disk, 1),
+		"DATASETS=" + string(datasetsJSON),
+		"NIXOS_FLAKE=" + configData.NixOS.Flake,
+	}
+
+}
+
+// runHooks function will run the hooks for a point in the install.
+// A failed hook either aborts the install or logs a warning.
+func runHooks(execute bool, configData config.Config, hook string, hooks []config.Hook, datasets []volume) {
+
+	if len(hooks) == 0 {
+		return
+	}
+
+	endStep := beginStep(hook)
+	env := hookEnv(configData, hook, datasets)
+	logger.Debugf("Hook environment: %s", strings.Join(env, " "))
+
+	for _, hookCommand := range hooks {
+		logger.Infof("Running %s hook: %s\n", hook, hookCommand.Command)
+		output, err := utils.ExecuteEnv(
+			execute,
+			env,
+			"sh",
+			"-c",
+			hookCommand.Command,
+		)
+
+		// The output is kept in the transcript.
+		for _, line := range strings.Split(strings.TrimRight(output, "\n"), "\n") {
+			if line != "" {
+				logger.Debugf("%s hook output: %s", hook, line)
+			}
+		}
+
+		if err != nil {
+			if hookCommand.OnFailure == config.HookWarn {
+				logger.Warnf("The %s hook '%s' failed, continuing: %s\n", hook, hookCommand.Command, err)
+				continue
+			}
+			validate.Panic(fmt.Errorf("the %s hook '%s' failed: %w", hook, hookCommand.Command, err))
+		}
+	}
+
+	endStep()
+
+}
@@ -0,0 +1,264 @@
+// Package installer contains the logic for installing NixOS.
+// This file contains the logic for running nixos-install.
+package installer
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+
+	config "github.com/MAHDTech/nixos-installer/pkg/config"
+	logger "github.com/MAHDTech/nixos-installer/pkg/logger"
+	utils "github.com/MAHDTech/nixos-installer/pkg/utils"
+	validate "github.com/MAHDTech/nixos-installer/pkg/validate"
+)
+
+// The nixos-install argument that skips the root password prompt.
+const nixOSInstallNoRootPassword = "--no-root-passwd"
+
+// The ways the system can be installed.
+const (
+	// installModeFlake builds the flake, substituting from the network.
+	installModeFlake = "flake"
+	// installModeCache builds the flake, substituting from the local binary cache.
+	installModeCache = "cache"
+	// installModeSystem installs a prebuilt system closure without evaluating the flake.
+	installModeSystem = "system"
+)
+
+// installMode function will return how the system is installed.
+func installMode(configData config.Config) string {
+	switch {
+	case configData.Install.System != "":
+		return installModeSystem
+	case configData.Install.Cache != "":
+		return installModeCache
+	default:
+		return installModeFlake
+	}
+}
+
+// rootPasswordSet function will return true if the root password is set from the configuration.
+func rootPasswordSet(configData config.Config) bool {
+	return configData.Install.RootPassword != "" || configData.Install.RootHashedPassword != ""
+}
+
+// installArgs function will return the arguments for nixos-install.
+func installArgs(configData config.Config) []string {
+
+	args := []string{
+		"--verbose",
+		"--root",
+		configData.MountPoint,
+	}
+
+	switch installMode(configData) {
+	case installModeSystem:
+		args = append(args, "--system", configData.Install.System)
+	case installModeCache:
+		args = append(args, "--impure", "--flake", configData.NixOS.Flake)
+		args = append(args, cacheArgs(configData)...)
+	default:
+		args = append(args, "--impure", "--flake", configData.NixOS.Flake)
+	}
+
+	// The root password is set after the install instead of prompting for it.
+	if rootPasswordSet(configData) && !slices.Contains(configData.Install.Args, nixOSInstallNoRootPassword) {
+		args = append(args, nixOSInstallNoRootPassword)
+	}
+
+	return append(args, configData.Install.Args...)
+
+}
+
+// installPrompts function will return true if nixos-install will prompt for the root password.
+func installPrompts(configData config.Config) bool {
+	return !slices.Contains(installArgs(configData), nixOSInstallNoRootPassword)
+}
+
+// installEnv function will return the environment of nixos-install as NAME=value in order.
+func installEnv(configData config.Config) []string {
+
+	env := []string{}
+	for name, value := range configData.Install.Env {
+		env = append(env, name+"="+value)
+	}
+	sort.Strings(env)
+
+	return env
+
+}
+
+// shellJoin function will join the arguments for printing as a shell command.
+func shellJoin(args []string) string {
+	quoted := []string{}
+	for _, arg := range args {
+		if strings.ContainsAny(arg, " \t\"'$") {
+			arg = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+		}
+		quoted = append(quoted, arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// checkSystem function will check the prebuilt system closure is available.
+func checkSystem(configData config.Config) error {
+
+	args := append(nixFlakeArgs, "path-info")
+	if configData.Install.Cache != "" {
+		args = append(args, "--store", configData.Install.Cache)
+	}
+	args = append(args, configData.Install.System)
+
+	logger.Infof("Checking system %s is available\n", configData.Install.System)
+	_, err := utils.Query("nix", args...)
+	if err != nil {
+		return fmt.Errorf("system %s is not available: %w", configData.Install.System, err)
+	}
+
+	return nil
+
+}
+
+// fetchSystem function will return true if the system must be copied from the cache to the live store.
+// A prebuilt system is already in the live store.
+func fetchSystem(configData config.Config) bool {
+	return installMode(configData) == installModeSystem && configData.Install.Cache != "" && !configData.Install.Prebuild
+}
+
+// cacheArgs function will return the nix arguments to substitute only from the cache.
+// The cache replaces the default substituters, so its key replaces the default trusted keys.
+func cacheArgs(configData config.Config) []string {
+
+	args := []string{"--option", "substituters", configData.Install.Cache}
+	if configData.Install.CacheKey != "" {
+		args = append(args, "--option", "trusted-public-keys", configData.Install.CacheKey)
+	}
+
+	return args
+
+}
+
+// fetchSystemArgs function will return the nix arguments to copy the system from the cache to the live store.
+// nix copy checks the signatures, so the key of the cache is trusted alongside the default keys.
+func fetchSystemArgs(configData config.Config) []string {
+
+	args := append([]string{}, nixFlakeArgs...)
+	if configData.Install.CacheKey != "" {
+		args = append(args, "--option", "extra-trusted-public-keys", configData.Install.CacheKey)
+	}
+
+	return append(args,
+		"copy",
+		"--from",
+		configData.Install.Cache,
+		configData.Install.System,
+	)
+
+}
+
+// nixOSInstall function will run nixos-install with the configured arguments and environment.
+func nixOSInstall(execute bool, configData config.Config) {
+
+	// nixos-install copies the system from the live store, so fetch it from the cache first.
+	if fetchSystem(configData) {
+		logger.Infof("Copying system %s from %s\n", configData.Install.System, configData.Install.Cache)
+		utils.Execute(
+			execute,
+			"nix",
+			fetchSystemArgs(configData)...,
+		)
+	}
+
+	args := append(installEnv(configData), "nixos-install")
+	args = append(args, installArgs(configData)...)
+
+	utils.Execute(
+		execute,
+		"env",
+		args...,
+	)
+
+}
+
+// setRootPassword function will set the root password in the shadow file of the target.
+// The users are mutable by default, so NixOS keeps the password on activation.
+func setRootPassword(execute bool, configData config.Config) {
+
+	shadowPath := path.Join(configData.MountPoint, "etc/shadow")
+
+	if !execute {
+		logger.Infof("DRY RUN: Would set the root password in %s\n", shadowPath)
+		return
+	}
+
+	// Hash a plain text password, it is passed on stdin so it is never logged.
+	hash := configData.Install.RootHashedPassword
+	if hash == "" {
+		output, err := utils.QueryInput(
+			configData.Install.RootPassword+"\n",
+			"mkpasswd",
+			"--method=sha-512",
+			"--stdin",
+		)
+		if err != nil {
+			validate.Panic(fmt.Errorf("unable to hash the root password: %w", err))
+		}
+		hash = strings.TrimSpace(output)
+	}
+
+	logger.Infof("Setting the root password in %s\n", shadowPath)
+
+	// #nosec G304
+	shadow, err := os.ReadFile(shadowPath)
+	validate.Panic(err)
+
+	found := false
+	lines := strings.Split(string(shadow), "\n")
+	for i, line := range lines {
+		fields := strings.Split(line, ":")
+		if len(fields) > 1 && fields[0] == "root" {
+			fields[1] = hash
+			lines[i] = strings.Join(fields, ":")
+			found = true
+		}
+	}
+	if !found {
+		validate.Panic(errors.New("root is missing from " + shadowPath))
+	}
+
+	err = os.WriteFile(shadowPath, []byte(strings.Join(lines, "\n")), os.FileMode(0600))
+	validate.Panic(err)
+
+}
+
+// addSSHKeys function will add the SSH keys to the authorized keys of root on the target.
+func addSSHKeys(execute bool, configData config.Config) {
+
+	authorizedKeysPath := path.Join(configData.MountPoint, "root/.ssh/authorized_keys")
+
+	if !execute {
+		logger.Infof("DRY RUN: Would add %d SSH keys to %s\n", len(configData.Install.SSHKeys), authorizedKeysPath)
+		return
+	}
+
+	logger.Infof("Adding %d SSH keys to %s\n", len(configData.Install.SSHKeys), authorizedKeysPath)
+
+	err := os.MkdirAll(path.Dir(authorizedKeysPath), os.FileMode(0700))
+	validate.Panic(err)
+
+	// #nosec G302 G304
+	file, err := os.OpenFile(authorizedKeysPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, os.FileMode(0600))
+	validate.Panic(err)
+	defer file.Close()
+
+	for _, key := range configData.Install.SSHKeys {
+		_, err = file.WriteString(strings.TrimSpace(key) + "\n")
+		validate.Panic(err)
+	}
+
+}
@@ -4,33 +4,40 @@ package installer
 import (
 	"flag"
 	"fmt"
-	"log"
 	"os"
 	"path"
-	"regexp"
 	"time"
 
 	config "github.com/MAHDTech/nixos-installer/pkg/config"
+	events "github.com/MAHDTech/nixos-installer/pkg/events"
+	logger "github.com/MAHDTech/nixos-installer/pkg/logger"
 	utils "github.com/MAHDTech/nixos-installer/pkg/utils"
 	validate "github.com/MAHDTech/nixos-installer/pkg/validate"
 )
 
-// Where nixos will be installed to.
-const mountPoint = "/mnt/nixos"
-
-// The names of the ZFS datasets.
+// The names of the ZFS datasets outside of the configured layout.
 const zfsDatasetBoot = "boot"
-const zfsDatasetRoot = "root"
-const zfsDatasetHome = "home"
-const zfsDatasetNixStore = "nix"
 const zfsDatasetSwap = "swap"
-const zfsDatasetTmp = "tmp"
-const zfsDatasetVar = "var"
-const zfsDatasetLib = "var/lib"
-const zfsDatasetDocker = "var/lib/docker"
+
+// Where the transcript is kept on the installed system.
+const installLogDir = "/var/log/nixos-installer"
+
+// The commands that can be given after the flags.
+// Without a command, a fresh install is performed.
+const commandReconcile = "reconcile"
+const commandTeardown = "teardown"
+const commandMount = "mount"
+const commandBootEnv = "bootenv"
+
+// The host ID of the running system.
+const hostIDFile = "/etc/hostid"
+
+// The name of the empty root snapshot used for impermanence.
+const zfsSnapshotBlank = "blank"
 
 // Run function is where the installer logic is executed.
-func Run() { //nolint:gocyclo
+// It returns the exit code, so the deferred clean up runs before the caller exits.
+func Run() (exitCode int) { //nolint:gocyclo
 
 	// Determine the path to the configuration file.
 	configFile := flag.String(
@@ -55,34 +62,211 @@ func Run() { //nolint:gocyclo
 		"Automatically install NixOS. (default is false which only generates the NixOS configuration)",
 	)
 
+	// When rescuing an install, optionally drop into it once mounted.
+	enter := flag.Bool(
+		"enter",
+		false,
+		"Run nixos-enter after mounting an existing install. (only used by the mount command)",
+	)
+
+	// The console log output.
+	logFormat := flag.String(
+		"log-format",
+		logger.FormatText,
+		"Log format, either 'text' or 'json'.",
+	)
+	logLevel := flag.String(
+		"log-level",
+		"info",
+		"Log level, one of 'debug', 'info', 'warn' or 'error'.",
+	)
+
+	// The transcript keeps every message and command regardless of the log level.
+	logFile := flag.String(
+		"log-file",
+		fmt.Sprintf("/tmp/nixos-installer-%s.log", time.Now().UTC().Format("20060102-150405")),
+		"Path to the transcript of every message and command, in JSON lines.",
+	)
+
+	// Progress events for other tools, e.g. fd:3 or unix:/run/installer.sock.
+	eventsTarget := flag.String(
+		"events",
+		"",
+		"Write JSON lines progress events to a file, 'fd:<number>' or 'unix:<socket path>'.",
+	)
+
 	// Parse the flags.
+	flag.Usage = usage
 	flag.Parse()
 
+	// Configure the logging before anything is logged.
+	validate.Error(logger.Configure(*logLevel, *logFormat))
+	validate.Error(logger.OpenTranscript(*logFile))
+	defer logger.Close()
+	logger.Infof("Writing the transcript to %s", *logFile)
+
+	// Start the progress events if requested.
+	if *eventsTarget != "" {
+		validate.Error(events.Open(*eventsTarget))
+		defer events.Close()
+	}
+
+	// A failed command panics, undo what the steps have done so far before exiting.
+	defer func() {
+		if failure := recover(); failure != nil {
+			rollback(*execute, failure)
+			logger.Errorf("The installer failed, see the summary above for the state of the disks.")
+			exitCode = 1
+		}
+	}()
+
+	// Determine the command to run.
+	command := flag.Arg(0)
+	switch command {
+	case "", commandReconcile, commandTeardown, commandMount, commandBootEnv:
+	default:
+		logger.Fatalf("Unknown command: %s\n", command)
+	}
+
 	if *execute {
-		log.Println("Running in execute mode.")
+		logger.Info("Running in execute mode.")
 	} else {
-		log.Println("Running in dry run mode, see '-help' for more information.")
+		logger.Info("Running in dry run mode, see '-help' for more information.")
 	}
 
 	// Read the YAML configuration file and parse it into a Config struct.
 	configData, err := config.ReadConfig(*configFile)
 	validate.Error(err)
 
+	// Model the system so a dry run can predict the commands that would fail.
+	if !*execute {
+		startSimulation(configData)
+		defer printSimulation(configData)
+	}
+
+	// Where nixos will be installed to.
+	mountPoint := configData.MountPoint
+
+	// The commands that change an existing pool only apply to ZFS.
+	if (command == commandReconcile || command == commandBootEnv) && configData.RootFS.Type != config.RootFSZFS {
+		logger.Fatalf("The %s command requires the zfs root filesystem, not %s\n", command, configData.RootFS.Type)
+	}
+
+	// Reconcile an existing pool instead of installing.
+	if command == commandReconcile {
+		endStep := beginStep(stepReconcile)
+		reconcile(*execute, configData)
+		endStep()
+		return
+	}
+
+	// Mount an existing install instead of installing.
+	if command == commandMount {
+		endStep := beginStep(stepMount)
+		rescue(*execute, configData, *enter)
+		endStep()
+		return
+	}
+
+	// Unmount and export the target instead of installing.
+	if command == commandTeardown {
+		endStep := beginStep(stepTeardown)
+		clean := teardown(*execute, configData)
+		endStep()
+		if !clean {
+			logger.Errorf("Teardown was incomplete.")
+			return 1
+		}
+		return
+	}
+
+	/*
+		##################################################
+			Host ID
+		##################################################
+	*/
+
+	// Generate a random host ID if one was not given, it is saved to the configuration file after the preflight.
+	// A boot environment shares the pool with the running system, which last imported it with its host ID.
+	hostIDGenerated := configData.NixOS.HostID == ""
+	hostIDSaved := false
+	if hostIDGenerated && command == commandBootEnv {
+		configData.NixOS.HostID, err = config.ReadHostID(hostIDFile)
+		if err != nil {
+			logger.Fatalf("Unable to read the host ID of the running system, set nixos.hostId to the host ID of the pool: %s\n", err)
+		}
+		logger.Infof("Using host ID %s of the running system from %s\n", configData.NixOS.HostID, hostIDFile)
+	} else if hostIDGenerated {
+		configData.NixOS.HostID, err = config.GenerateHostID()
+		validate.Error(err)
+		logger.Infof("Generated host ID %s\n", configData.NixOS.HostID)
+	}
+
+	/*
+		##################################################
+			Preflight
+		##################################################
+	*/
+
+	// Make sure the flake can be installed before any disks are wiped.
+	// With a flake source, the source is checked as the copy doesn't exist yet.
+	endStep := beginStep(stepPreflight)
+	logger.Infof("Installing in %s mode\n", installMode(configData))
+	if installMode(configData) == installModeSystem {
+		// A prebuilt system skips the flake evaluation entirely.
+		err = checkSystem(configData)
+	} else {
+		var drvPath string
+		drvPath, err = checkFlake(configData)
+		if err == nil {
+			logger.Infof("Flake %s evaluates to %s\n", preflightFlake(configData), drvPath)
+		}
+	}
+	if err == nil {
+		err = checkUnlock(configData)
+	}
+	if err == nil {
+		err = checkDatasetEncryption(zfsDatasets(configData))
+	}
+	if err != nil {
+		logger.Fatalf("Preflight check failed, no changes have been made: %s\n", err)
+	}
+	endStep()
+
+	// Build the system now so a failed build leaves the disks untouched.
+	if configData.Install.Prebuild {
+		endStep = beginStep(stepPrebuild)
+		configData.Install.System = prebuildSystem(*execute, configData)
+		endStep()
+	}
+
+	// Keep the host ID in the configuration file now the preflight has passed.
+	if hostIDGenerated {
+		if !*execute {
+			logger.Infof("DRY RUN: Would save host ID %s to %s\n", configData.NixOS.HostID, *configFile)
+		} else if err := config.SaveHostID(*configFile, configData.NixOS.HostID); err != nil {
+			logger.Warnf("Unable to save the host ID to %s: %s\n", *configFile, err)
+		} else {
+			logger.Infof("Saved host ID %s to %s\n", configData.NixOS.HostID, *configFile)
+			hostIDSaved = true
+		}
+	}
+
 	/*
 		##################################################
 			Mountpoints
 		##################################################
 	*/
 
-	// Capture all mountpoints from stdout
-	mountpointsString := utils.ExecuteStdOut(
-		true,
+	// Capture all mountpoints from stdout, lsblk is read-only so it also runs in a dry run.
+	mountpointsString, err := utils.Query(
 		"lsblk",
 		"--noheadings",
 		"--json",
 		"--output",
 		"ID,MOUNTPOINTS",
 	)
+	validate.Error(err)
 	// Convert the string into JSON
 	mountpointsJSON := []byte(mountpointsString)
 
@@ -92,8 +276,10 @@ func Run() { //nolint:gocyclo
 		##################################################
 	*/
 
+	endStep = beginStep(stepDirectories)
+
 	// Create the directories where the temporary mount points will be created.
-	log.Printf("Creating mount directory %s\n", mountPoint)
+	logger.Infof("Creating mount directory %s\n", mountPoint)
 	utils.Execute(
 		*execute,
 		"mkdir",
@@ -101,19 +287,28 @@ func Run() { //nolint:gocyclo
 		mountPoint,
 	)
 
-	// Create mount point for 'boot'
-	mountPointBoot := path.Join(mountPoint, "boot")
-	log.Printf("Creating mount point for 'boot' at: %s\n", mountPointBoot)
-	utils.Execute(
-		*execute,
-		"mkdir",
-		"-p",
-		mountPointBoot,
-	)
+	// Determine the dataset layout of the root filesystem.
+	rootFS := newFilesystem(configData, command == commandBootEnv)
+	datasetLayout := rootFS.layout()
 
-	// Create mount point for 'efi'
-	mountPointUEFI := path.Join(mountPoint, "boot/efi")
-	log.Printf("Creating mount point for 'efi' at: %s\n", mountPointUEFI)
+	// Create mount points for the datasets.
+	for _, dataset := range volumeMountOrder(datasetLayout) {
+		if !dataset.mounted() || dataset.Mountpoint == "/" {
+			continue
+		}
+		mountPointDataset := path.Join(mountPoint, dataset.Mountpoint)
+		logger.Infof("Creating mount point for '%s' at: %s\n", dataset.Path, mountPointDataset)
+		utils.Execute(
+			*execute,
+			"mkdir",
+			"-p",
+			mountPointDataset,
+		)
+	}
+
+	// Create mount point for 'efi' which depends on the bootloader.
+	mountPointUEFI := path.Join(mountPoint, espMountPath(configData))
+	logger.Infof("Creating mount point for 'efi' at: %s\n", mountPointUEFI)
 	utils.Execute(
 		*execute,
 		"mkdir",
@@ -123,7 +318,7 @@ func Run() { //nolint:gocyclo
 
 	// Create mount point for 'nixos' configuration.
 	mountPointNixOSConfig := path.Join(mountPoint, "boot/nixos")
-	log.Printf("Creating mount point for 'nixos-config' at: %s\n", mountPointNixOSConfig)
+	logger.Infof("Creating mount point for 'nixos-config' at: %s\n", mountPointNixOSConfig)
 	utils.Execute(
 		*execute,
 		"mkdir",
@@ -131,66 +326,252 @@ func Run() { //nolint:gocyclo
 		mountPointNixOSConfig,
 	)
 
-	// Create mount point for 'home'
-	mountPointHome := path.Join(mountPoint, "home")
-	log.Printf("Creating mount point for 'home' at: %s\n", mountPointHome)
-	utils.Execute(
-		*execute,
-		"mkdir",
-		"-p",
-		mountPointHome,
-	)
+	endStep()
 
-	// Create mount point for 'nix'
-	mountPointNix := path.Join(mountPoint, "nix")
-	log.Printf("Creating mount point for 'nix' at: %s\n", mountPointNix)
-	utils.Execute(
-		*execute,
-		"mkdir",
-		"-p",
-		mountPointNix,
-	)
+	runHooks(*execute, configData, hookPrePartition, configData.Hooks.PrePartition, datasetLayout)
 
-	// Create mount point for 'var'
-	mountPointVar := path.Join(mountPoint, "var")
-	log.Printf("Creating mount point for 'var' at: %s\n", mountPointVar)
-	utils.Execute(
-		*execute,
-		"mkdir",
-		"-p",
-		mountPointVar,
-	)
+	// Add a boot environment to the existing pool, otherwise start from empty disks.
+	if command == commandBootEnv {
+		endStep = beginStep(stepBootEnv)
+	} else {
+		endStep = beginStep(stepUEFI)
+		prepareUEFI(*execute, configData, mountpointsJSON)
+		endStep()
 
-	// Create mount point for 'lib'
-	mountPointLib := path.Join(mountPoint, "var/lib")
-	log.Printf("Creating mount point for 'var' at: %s\n", mountPointLib)
-	utils.Execute(
-		*execute,
-		"mkdir",
-		"-p",
-		mountPointLib,
-	)
+		if configData.RootFS.Type == config.RootFSZFS {
+			endStep = beginStep(stepPools)
+		} else {
+			endStep = beginStep(stepFilesystem)
+		}
+	}
+	rootFS.create(*execute, configData, mountpointsJSON)
+	endStep()
 
-	// Create mount point for 'docker'
-	mountPointDocker := path.Join(mountPoint, "var/lib/docker")
-	log.Printf("Creating mount point for 'var' at: %s\n", mountPointDocker)
-	utils.Execute(
-		*execute,
-		"mkdir",
-		"-p",
-		mountPointDocker,
-	)
+	/*
+		##################################################
+			Datasets
+		##################################################
+	*/
+
+	endStep = beginStep(stepDatasets)
+	rootFS.createVolumes(*execute, configData)
+	endStep()
+
+	/*
+		##################################################
+			Mount directories
+		##################################################
+	*/
+
+	endStep = beginStep(stepMount)
+	logger.Info("Mounting directories.")
+	mountTarget(*execute, configData, rootFS)
+
+	// Create the Secure Boot key location for lanzaboote.
+	if configData.Bootloader.Type == config.BootloaderLanzaboote {
+		mountPointPKIBundle := path.Join(mountPoint, lanzabootePKIBundle)
+		logger.Infof("Creating lanzaboote PKI bundle directory at: %s\n", mountPointPKIBundle)
+		utils.Execute(
+			*execute,
+			"mkdir",
+			"-p",
+			mountPointPKIBundle,
+		)
+	}
+	endStep()
 
-	// Create mount point for 'tmp'
-	mountPointTmp := path.Join(mountPoint, "tmp")
-	log.Printf("Creating mount point for 'tmp' at: %s\n", mountPointTmp)
+	runHooks(*execute, configData, hookPostMount, configData.Hooks.PostMount, datasetLayout)
+
+	// Copy the flake onto the NixOS config partition and install from there.
+	if configData.NixOS.Config.Source != "" {
+		endStep = beginStep(stepFlake)
+		configData.NixOS.Flake = copyFlakeSource(*execute, configData)
+		logger.Infof("Installing from flake %s\n", configData.NixOS.Flake)
+		endStep()
+	}
+
+	/*
+		##################################################
+			NixOS
+		##################################################
+	*/
+
+	// Generate the NixOS configuration.
+	endStep = beginStep(stepNixOSConfig)
+
+	// Write the host ID to the target so the pools import cleanly on the first boot.
+	if configData.RootFS.Type == config.RootFSZFS {
+		mountPointHostID := path.Join(mountPoint, "etc/hostid")
+		logger.Infof("Writing host ID %s to %s\n", configData.NixOS.HostID, mountPointHostID)
+		utils.Execute(
+			*execute,
+			"mkdir",
+			"-p",
+			path.Dir(mountPointHostID),
+		)
+		utils.Execute(
+			*execute,
+			"zgenhostid",
+			"-f",
+			"-o",
+			mountPointHostID,
+			configData.NixOS.HostID,
+		)
+	}
+
+	logger.Info("Generating NixOS configuration.")
 	utils.Execute(
 		*execute,
-		"mkdir",
-		"-p",
-		mountPointTmp,
+		"nixos-generate-config",
+		"--root",
+		mountPoint,
 	)
 
+	// Read the default NixOS configuration.
+	if !*execute {
+		logger.Info("Dry run, skipping NixOS configuration modification...")
+		for _, setting := range nixOSSettings(configData, rootFS) {
+			logger.Infof("DRY RUN: Would add setting %s\n", setting)
+		}
+	} else {
+		nixOSConfigPath := path.Join(mountPoint, "etc/nixos/configuration.nix")
+
+		// #nosec G304
+		nixOSConfigDefault, err := os.ReadFile(nixOSConfigPath)
+		validate.Panic(err)
+
+		// Add the host id and the settings for the layout.
+		nixOSSettingsNew := []string{
+			fmt.Sprintf("networking.hostId = \"%s\";", configData.NixOS.HostID),
+		}
+		nixOSSettingsNew = append(nixOSSettingsNew, nixOSSettings(configData, rootFS)...)
+		nixOSConfigNew := updateNixOSConfig(string(nixOSConfigDefault), nixOSSettingsNew)
+
+		// Write the new NixOS configuration with 0600 permissions.
+		err = os.WriteFile(
+			nixOSConfigPath,
+			[]byte(nixOSConfigNew),
+			os.FileMode(0600),
+		)
+		validate.Panic(err)
+	}
+	endStep()
+
+	runHooks(*execute, configData, hookPostGenerateConfig, configData.Hooks.PostGenerateConfig, datasetLayout)
+
+	// Enroll the TPM2 or FIDO2 token that unlocks the pool on boot.
+	if unlockEnrolled(configData) {
+		endStep = beginStep(stepUnlock)
+		enrollUnlock(*execute, configData, command != commandBootEnv)
+		endStep()
+	}
+
+	// Provision the keys the flake decrypts its secrets with.
+	if configData.Secrets.Enabled {
+		endStep = beginStep(stepSecrets)
+		provisionSecrets(*execute, configData, *executeInstall)
+		endStep()
+	}
+
+	// Install NixOS.
+	if *executeInstall {
+		endStep = beginStep(stepInstall)
+		logger.Info("Installing NixOS...")
+		if installPrompts(configData) {
+			events.PromptRequired("nixos-install will ask for the new root password.")
+		}
+		nixOSInstall(*execute, configData)
+
+		// The system is installed, a later failure must not roll it back.
+		clearUndo()
+		recordChange("NixOS was installed to %s and is kept.", mountPoint)
+
+		// Make the machine loginable without a prompt for unattended installs.
+		if rootPasswordSet(configData) {
+			setRootPassword(*execute, configData)
+		}
+		if len(configData.Install.SSHKeys) > 0 {
+			addSSHKeys(*execute, configData)
+		}
+
+		endStep()
+
+		runHooks(*execute, configData, hookPostInstall, configData.Hooks.PostInstall, datasetLayout)
+
+		// Snapshot the freshly installed system as a baseline.
+		endStep = beginStep(stepSnapshots)
+		rootFS.snapshot(*execute, configData)
+		endStep()
+
+		// Leave the pools exported so they import cleanly on the next boot.
+		endStep = beginStep(stepTeardown)
+
+		// Keep the transcript on the installed system, including the hooks and snapshots.
+		// The teardown is not included as the copy needs the target mounted, the full transcript stays in -log-file.
+		mountPointLog := path.Join(mountPoint, installLogDir, path.Base(logger.TranscriptPath()))
+		logger.Infof("Copying the transcript to %s", mountPointLog)
+		utils.Execute(
+			*execute,
+			"install",
+			"-D",
+			"-m",
+			"0600",
+			logger.TranscriptPath(),
+			mountPointLog,
+		)
+
+		logger.Info("Tearing down the target.")
+		clean := teardown(*execute, configData)
+		endStep()
+		if clean {
+			fmt.Println("")
+			fmt.Println("NixOS has been installed, you can now reboot.")
+			fmt.Println("")
+		}
+	} else {
+		fmt.Println("")
+		fmt.Println("You can now edit the NixOS configuration and install NixOS by running:")
+		fmt.Println("")
+		for _, env := range installEnv(configData) {
+			fmt.Printf("export %s\n", env)
+		}
+		if fetchSystem(configData) {
+			fmt.Printf("sudo nix %s\n", shellJoin(fetchSystemArgs(configData)))
+		}
+		fmt.Printf("sudo -E nixos-install %s\n", shellJoin(installArgs(configData)))
+		fmt.Println("")
+		fmt.Println("If needed, remember you can re-run the nixos-install command after making additional changes before rebooting.")
+		fmt.Println("")
+		if rootPasswordSet(configData) || len(configData.Install.SSHKeys) > 0 {
+			fmt.Println("TIP: The root password and SSH keys from the install section are only set when using the '-install' flag.")
+		}
+		if configData.Bootloader.Type == config.BootloaderLanzaboote {
+			fmt.Printf("TIP: Create the Secure Boot keys in %s with 'sbctl create-keys' before enabling lanzaboote.\n", lanzabootePKIBundle)
+		}
+		if configData.NixOS.Config.Enabled && configData.NixOS.Config.Source == "" {
+			fmt.Printf("TIP: When using the NixOS config partition, it's a good idea to copy your flake locally to %s\n", mountPointNixOSConfig)
+		}
+		fmt.Println("")
+		fmt.Println("REMINDER: Ensure the disk IDs are correctly set in the hardware-configuration.nix file!")
+		fmt.Println("")
+	}
+
+	// A generated host ID must be kept in the flake for the pools to import.
+	if hostIDGenerated {
+		fmt.Printf("IMPORTANT: The host ID was set to %s, set networking.hostId = \"%s\"; in your flake.\n", configData.NixOS.HostID, configData.NixOS.HostID)
+		if *execute && !hostIDSaved {
+			fmt.Printf("IMPORTANT: The host ID could not be saved, add hostId: \"%s\" to the nixos section of %s.\n", configData.NixOS.HostID, *configFile)
+		}
+		fmt.Println("")
+	}
+
+	return 0
+
+}
+
+// prepareUEFI function will partition and format the UEFI disk.
+func prepareUEFI(execute bool, configData config.Config, mountpointsJSON []byte) {
+
 	/*
 		##################################################
 			UEFI
@@ -203,35 +584,36 @@ func Run() { //nolint:gocyclo
 		mountpointsJSON,
 	)
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatal(err)
 	}
 
 	// Unmount all mountpoints for the UEFI device
-	err = utils.UnmountAll(*execute, mountpointsUEFI)
+	err = utils.UnmountAll(execute, mountpointsUEFI)
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatal(err)
 	}
 
 	// Zap the UEFI target device.
-	log.Printf("Zapping %s.\n", configData.UEFI.Disk)
+	logger.Infof("Zapping %s.\n", configData.UEFI.Disk)
 	utils.Execute(
-		*execute,
+		execute,
 		"sgdisk",
 		"--zap-all",
 		configData.UEFI.Disk,
 	)
+	recordChange("%s was wiped and repartitioned for the ESP.", configData.UEFI.Disk)
 
 	// Run partprobe to update the partition table.
-	log.Println("Running partprobe to update the partition table.")
+	logger.Info("Running partprobe to update the partition table.")
 	utils.ExecuteSilent(
-		*execute,
+		execute,
 		"partprobe",
 	)
 
 	// Prepare the UEFI disk.
-	log.Printf("Preparing UEFI disk %s.\n", configData.UEFI.Disk)
+	logger.Infof("Preparing UEFI disk %s.\n", configData.UEFI.Disk)
 	utils.Execute(
-		*execute,
+		execute,
 		"parted",
 		"--script",
 		"--fix",
@@ -244,14 +626,14 @@ func Run() { //nolint:gocyclo
 	)
 
 	// Create the UEFI partition.
-	log.Printf(
+	logger.Infof(
 		"Creating UEFI partition on %s with label %s and size %s.\n",
 		configData.UEFI.Disk,
 		configData.UEFI.Label,
 		configData.UEFI.Size,
 	)
 	utils.Execute(
-		*execute,
+		execute,
 		"parted",
 		"--script",
 		"--fix",
@@ -267,9 +649,9 @@ func Run() { //nolint:gocyclo
 	)
 
 	// Set the ESP flag on the partition.
-	log.Printf("Setting the ESP flag on %s.\n", configData.UEFI.Disk)
+	logger.Infof("Setting the ESP flag on %s.\n", configData.UEFI.Disk)
 	utils.Execute(
-		*execute,
+		execute,
 		"parted",
 		"--script",
 		"--fix",
@@ -286,9 +668,9 @@ func Run() { //nolint:gocyclo
 	// Create the NixOS configuration partition if it is enabled.
 	if configData.NixOS.Config.Enabled {
 
-		log.Printf("Creating NixOS config partition on %s.\n", configData.UEFI.Disk)
+		logger.Infof("Creating NixOS config partition on %s.\n", configData.UEFI.Disk)
 		utils.Execute(
-			*execute,
+			execute,
 			"parted",
 			"--script",
 			"--fix",
@@ -304,20 +686,20 @@ func Run() { //nolint:gocyclo
 		)
 
 	} else {
-		log.Println("Skipping NixOS config partition creation as it is disabled.")
+		logger.Info("Skipping NixOS config partition creation as it is disabled.")
 	}
 
 	// Sleep a few seconds to allow the partition table to update.
-	if *execute {
-		log.Println("Waiting...")
+	if execute {
+		logger.Info("Waiting...")
 		time.Sleep(5 * time.Second)
 	}
 
 	// Format the UEFI partition.
-	partitionNameUEFI := fmt.Sprintf("%s-part1", configData.UEFI.Disk)
-	log.Printf("Formatting UEFI partition: %s\n", partitionNameUEFI)
+	partitionNameUEFI := partitionName(configData.UEFI.Disk, 1)
+	logger.Infof("Formatting UEFI partition: %s\n", partitionNameUEFI)
 	utils.Execute(
-		*execute,
+		execute,
 		"mkfs.vfat",
 		"-n",
 		"EFI",
@@ -325,22 +707,28 @@ func Run() { //nolint:gocyclo
 	)
 
 	// Format the NixOS config partition if it is enabled.
-	var partitionNameNixOSConfig string
 	if configData.NixOS.Config.Enabled {
 
-		partitionNameNixOSConfig = fmt.Sprintf("%s-part2", configData.UEFI.Disk)
-		log.Printf("Formatting NixOS config partition: %s\n", partitionNameNixOSConfig)
+		partitionNameNixOSConfig := partitionName(configData.UEFI.Disk, 2)
+		logger.Infof("Formatting NixOS config partition: %s\n", partitionNameNixOSConfig)
 		utils.Execute(
-			*execute,
+			execute,
 			"mkfs.xfs",
 			"-f",
 			partitionNameNixOSConfig,
 		)
 
 	} else {
-		log.Println("Skipping NixOS config partition formatting as it is disabled.")
+		logger.Info("Skipping NixOS config partition formatting as it is disabled.")
 	}
 
+}
+
+// createPools function will wipe the ZFS disks and create the pools.
+func createPools(execute bool, configData config.Config, mountpointsJSON []byte) {
+
+	mountPoint := configData.MountPoint
+
 	/*
 		##################################################
 			ZFS Pool
@@ -350,34 +738,60 @@ func Run() { //nolint:gocyclo
 	// Determine the name of the ZFS pool.
 	zfsPoolName := configData.ZFS.Pool.Name
 
+	// The pools record the host ID that imported them, use the one the installed system will have.
+	logger.Infof("Setting the host ID to %s.\n", configData.NixOS.HostID)
+	utils.Execute(
+		execute,
+		"zgenhostid",
+		"-f",
+		configData.NixOS.HostID,
+	)
+
 	// Destroy any existing ZFS pool using that name.
-	log.Printf("Destroying existing ZFS pool %s.\n", zfsPoolName)
+	logger.Infof("Destroying existing ZFS pool %s.\n", zfsPoolName)
 	utils.ExecuteSilent(
-		*execute,
+		execute,
 		"zpool",
 		"destroy",
 		"-f",
 		zfsPoolName,
 	)
 
+	// Destroy any existing ZFS boot pool using that name.
+	if configData.ZFS.BootPool.Enabled {
+		logger.Infof("Destroying existing ZFS boot pool %s.\n", configData.ZFS.BootPool.Name)
+		utils.ExecuteSilent(
+			execute,
+			"zpool",
+			"destroy",
+			"-f",
+			configData.ZFS.BootPool.Name,
+		)
+	}
+
+	// Close any LUKS devices left open on the disks.
+	if luksEnabled(configData) {
+		closeLUKS(execute, configData)
+	}
+
 	for _, zfsDisk := range configData.ZFS.Disks {
 
 		// Determine if and where the ZFS device is currently mounted.
 		mountpointsZFS, err := utils.GetMountpoints(zfsDisk, mountpointsJSON)
 		if err != nil {
-			log.Fatal(err)
+			validate.Panic(err)
 		}
 
 		// Unmount all mountpoints for the ZFS device
-		err = utils.UnmountAll(*execute, mountpointsZFS)
+		err = utils.UnmountAll(execute, mountpointsZFS)
 		if err != nil {
-			log.Fatal(err)
+			validate.Panic(err)
 		}
 
 		// Clear any current ZFS label on the disk.
-		log.Printf("Clearing ZFS pool label on %s.\n", zfsDisk)
+		logger.Infof("Clearing ZFS pool label on %s.\n", zfsDisk)
 		utils.ExecuteSilent(
-			*execute,
+			execute,
 			"zpool",
 			"labelclear",
 			"-f",
@@ -385,25 +799,55 @@ func Run() { //nolint:gocyclo
 		)
 
 		// Zap the ZFS Pool disks.
-		log.Printf("Zapping %s.\n", zfsDisk)
+		logger.Infof("Zapping %s.\n", zfsDisk)
 		utils.Execute(
-			*execute,
+			execute,
 			"sgdisk",
 			"--zap-all",
 			zfsDisk,
 		)
+		recordChange("%s was wiped for the ZFS pool.", zfsDisk)
+
+		// Split the disk into boot pool and pool partitions if required.
+		if configData.ZFS.BootPool.Enabled {
+			logger.Infof(
+				"Creating boot pool partition on %s with size %s.\n",
+				zfsDisk,
+				configData.ZFS.BootPool.Size,
+			)
+			utils.Execute(
+				execute,
+				"parted",
+				"--script",
+				"--fix",
+				"--align",
+				"optimal",
+				zfsDisk,
+				"--",
+				"mklabel",
+				"gpt",
+				"mkpart",
+				configData.ZFS.BootPool.Name,
+				"1MiB",
+				configData.ZFS.BootPool.Size,
+				"mkpart",
+				zfsPoolName,
+				configData.ZFS.BootPool.Size,
+				"100%",
+			)
+		}
 	}
 
 	// Run partprobe to update the partition table.
-	log.Println("Running partprobe to update the partition table.")
+	logger.Info("Running partprobe to update the partition table.")
 	utils.ExecuteSilent(
-		*execute,
+		execute,
 		"partprobe",
 	)
 
 	// Sleep a few seconds to allow the partition table to update.
-	if *execute {
-		log.Println("Waiting...")
+	if execute {
+		logger.Info("Waiting...")
 		time.Sleep(5 * time.Second)
 	}
 
@@ -415,11 +859,14 @@ func Run() { //nolint:gocyclo
 		zpoolArgs = append(zpoolArgs, "-O", "compression=zstd-3")
 	}
 
-	// If encryption is enabled, add the encryption option.
-	if configData.ZFS.Pool.Encryption {
-		zpoolArgs = append(zpoolArgs, "-O", "encryption=aes-256-gcm")
-		zpoolArgs = append(zpoolArgs, "-O", "keyformat=passphrase")
-		zpoolArgs = append(zpoolArgs, "-O", "keylocation=prompt")
+	// The key sealed to the TPM2 is generated before any encryption root is created.
+	if zfsKeySealed(configData) {
+		createZFSKey(execute, configData)
+	}
+
+	// If native encryption is enabled for the whole pool, add the encryption option.
+	if zfsPoolEncrypted(configData) {
+		zpoolArgs = append(zpoolArgs, zfsEncryptionArgs(configData, "-O", zfsKeySealed(configData))...)
 	}
 
 	// Set additional file system properties using the '-O' flag.
@@ -441,6 +888,13 @@ func Run() { //nolint:gocyclo
 	zpoolArgs = append(zpoolArgs, "-o", "autotrim=on")
 	zpoolArgs = append(zpoolArgs, "-o", "ashift=12")
 
+	// Restrict the pool features if a compatibility is set.
+	if configData.ZFS.Pool.Compatibility != "" {
+		zpoolArgs = append(zpoolArgs, "-o", "compatibility="+configData.ZFS.Pool.Compatibility)
+	} else if bootOnZFS(configData) && !configData.ZFS.BootPool.Enabled {
+		logger.Warn("/boot is on a pool without 'compatibility=grub2', GRUB may not be able to read it.")
+	}
+
 	// Set the temporary mount argument.
 	zpoolArgs = append(zpoolArgs, "-R", mountPoint)
 
@@ -450,368 +904,64 @@ func Run() { //nolint:gocyclo
 	// If there is more than one root disk, we need to mirror or stripe them.
 	if len(configData.ZFS.Disks) > 1 {
 		if configData.ZFS.Pool.Mirror {
-			log.Println("Creating mirrored ZFS pool.")
+			logger.Info("Creating mirrored ZFS pool.")
 			zpoolArgs = append(zpoolArgs, "mirror")
 		} else if configData.ZFS.Pool.Stripe {
-			log.Println("Creating striped ZFS pool.")
+			logger.Info("Creating striped ZFS pool.")
 		}
 	}
 
+	// Wrap the root disks in LUKS before creating the pool on them.
+	if luksEnabled(configData) {
+		formatLUKS(execute, configData)
+	}
+
 	// Append the root disks to the zpool arguments.
-	zpoolArgs = append(zpoolArgs, configData.ZFS.Disks...)
+	zpoolArgs = append(zpoolArgs, zpoolVdevDevices(configData)...)
 
 	// Create the ZFS pool.
-	log.Printf("Creating ZFS pool %s.\n", zfsPoolName)
+	logger.Infof("Creating ZFS pool %s.\n", zfsPoolName)
+	if zfsPoolEncrypted(configData) && !zfsKeySealed(configData) {
+		events.PromptRequired("zpool create will ask for the new encryption passphrase.")
+	}
 	utils.Execute(
-		*execute,
+		execute,
 		"zpool",
 		zpoolArgs...,
 	)
+	registerUndo("Export ZFS pool "+zfsPoolName, "zpool", "export", zfsPoolName)
+	recordChange("ZFS pool %s was created and still exists on the disks.", zfsPoolName)
 
-	/*
-		##################################################
-			ZFS Datasets
-		##################################################
-	*/
-
-	log.Println("Creating ZFS datasets.")
-
-	// Create the root dataset.
-	zfsDatasetPathRoot := path.Join(zfsPoolName, zfsDatasetRoot)
-	log.Printf("Creating root dataset: %s\n", zfsDatasetPathRoot)
-	utils.Execute(
-		*execute,
-		"zfs",
-		"create",
-		"-o",
-		"mountpoint=legacy",
-		zfsDatasetPathRoot,
-	)
-
-	// Create the boot dataset.
-	zfsDatasetPathBoot := path.Join(zfsPoolName, zfsDatasetBoot)
-	log.Printf("Creating boot dataset: %s\n", zfsDatasetPathBoot)
-	utils.Execute(
-		*execute,
-		"zfs",
-		"create",
-		"-o",
-		"mountpoint=legacy",
-		zfsDatasetPathBoot,
-	)
-
-	// Create the home dataset.
-	zfsDataSetPathHome := path.Join(zfsPoolName, zfsDatasetHome)
-	log.Printf("Creating home dataset: %s\n", zfsDataSetPathHome)
-	utils.Execute(
-		*execute,
-		"zfs",
-		"create",
-		"-o",
-		"mountpoint=legacy",
-		zfsDataSetPathHome,
-	)
-
-	// Create the nix dataset.
-	zfsDataSetPathNix := path.Join(zfsPoolName, zfsDatasetNixStore)
-	log.Printf("Creating nix dataset: %s\n", zfsDataSetPathNix)
-	utils.Execute(
-		*execute,
-		"zfs",
-		"create",
-		"-o",
-		"mountpoint=legacy",
-		zfsDataSetPathNix,
-	)
-
-	// Create the swap dataset if it is enabled.
-	if configData.Swap.Enabled {
-		zfsDataSetPathSwap := path.Join(zfsPoolName, zfsDatasetSwap)
-		log.Printf("Creating swap dataset: %s\n", zfsDataSetPathSwap)
-		utils.Execute(
-			*execute,
-			"zfs",
-			"create",
-			"-V",
-			configData.Swap.Size,
-			zfsDataSetPathSwap,
-		)
-	} else {
-		log.Println("Skipping swap dataset creation as it is disabled.")
+	if zfsPoolEncrypted(configData) && zfsKeySealed(configData) {
+		promptKeyLocation(execute, zfsPoolName)
 	}
 
-	// Create the tmp dataset.
-	zfsDataSetPathTmp := path.Join(zfsPoolName, zfsDatasetTmp)
-	log.Printf("Creating tmp dataset: %s\n", zfsDataSetPathTmp)
-	utils.Execute(
-		*execute,
-		"zfs",
-		"create",
-		"-o",
-		"mountpoint=legacy",
-		zfsDataSetPathTmp,
-	)
-
-	// Create the var dataset.
-	zfsDataSetPathVar := path.Join(zfsPoolName, zfsDatasetVar)
-	log.Printf("Creating var dataset: %s\n", zfsDataSetPathVar)
-	utils.Execute(
-		*execute,
-		"zfs",
-		"create",
-		"-o",
-		"mountpoint=legacy",
-		zfsDataSetPathVar,
-	)
-
-	// Create the lib dataset.
-	zfsDataSetPathLib := path.Join(zfsPoolName, zfsDatasetLib)
-	log.Printf("Creating lib dataset: %s\n", zfsDataSetPathLib)
-	utils.Execute(
-		*execute,
-		"zfs",
-		"create",
-		"-o",
-		"mountpoint=legacy",
-		zfsDataSetPathLib,
-	)
-
-	// Create the docker dataset.
-	zfsDataSetPathDocker := path.Join(zfsPoolName, zfsDatasetDocker)
-	log.Printf("Creating docker dataset: %s\n", zfsDataSetPathDocker)
-	utils.Execute(
-		*execute,
-		"zfs",
-		"create",
-		"-o",
-		"mountpoint=legacy",
-		zfsDataSetPathDocker,
-	)
-
-	/*
-		##################################################
-			Mount directories
-		##################################################
-	*/
-
-	log.Println("Mounting directories.")
-
-	// Mount the root dataset.
-	log.Printf("Mounting %s to %s.\n", zfsDatasetPathRoot, mountPoint)
-	utils.Execute(
-		*execute,
-		"mount",
-		"-o",
-		"X-mount.mkdir",
-		"-t",
-		"zfs",
-		zfsDatasetPathRoot,
-		mountPoint,
-	)
-
-	// Mount the boot dataset.
-	log.Printf("Mounting %s to %s.\n", zfsDatasetPathBoot, mountPointBoot)
-	utils.Execute(
-		*execute,
-		"mount",
-		"-o",
-		"X-mount.mkdir",
-		"-t",
-		"zfs",
-		zfsDatasetPathBoot,
-		mountPointBoot,
-	)
-
-	// Mount the UEFI partition.
-	log.Printf("Mounting %s to %s.\n", partitionNameUEFI, mountPointUEFI)
-	utils.Execute(
-		*execute,
-		"mount",
-		"-t",
-		"vfat",
-		"-o",
-		"fmask=0077,dmask=0077,iocharset=iso8859-1,X-mount.mkdir",
-		partitionNameUEFI,
-		mountPointUEFI,
-	)
-
-	// Mount the NixOS config partition if it is enabled.
-	if configData.NixOS.Config.Enabled {
-		log.Printf("Mounting %s to %s.\n", partitionNameNixOSConfig, mountPointNixOSConfig)
+	// Create the ZFS boot pool if it is enabled.
+	if configData.ZFS.BootPool.Enabled {
+		logger.Infof("Creating ZFS boot pool %s.\n", configData.ZFS.BootPool.Name)
 		utils.Execute(
-			*execute,
-			"mount",
-			"-o",
-			"X-mount.mkdir",
-			"-t",
-			"xfs",
-			partitionNameNixOSConfig,
-			mountPointNixOSConfig,
+			execute,
+			"zpool",
+			bootPoolArgs(configData, mountPoint)...,
 		)
+		registerUndo("Export ZFS boot pool "+configData.ZFS.BootPool.Name, "zpool", "export", configData.ZFS.BootPool.Name)
+		recordChange("ZFS boot pool %s was created and still exists on the disks.", configData.ZFS.BootPool.Name)
 	} else {
-		log.Println("Skipping NixOS config partition mounting as it is disabled.")
+		logger.Info("Skipping ZFS boot pool creation as it is disabled.")
 	}
 
-	// Mount the home dataset.
-	log.Printf("Mounting %s to %s.\n", zfsDataSetPathHome, mountPointHome)
-	utils.Execute(
-		*execute,
-		"mount",
-		"-o",
-		"X-mount.mkdir",
-		"-t",
-		"zfs",
-		zfsDataSetPathHome,
-		mountPointHome,
-	)
-
-	// Mount the nix dataset.
-	log.Printf("Mounting %s to %s.\n", zfsDataSetPathNix, mountPointNix)
-	utils.Execute(
-		*execute,
-		"mount",
-		"-o",
-		"X-mount.mkdir",
-		"-t",
-		"zfs",
-		zfsDataSetPathNix,
-		mountPointNix,
-	)
-
-	// Mount the var dataset.
-	log.Printf("Mounting %s to %s.\n", zfsDataSetPathVar, mountPointVar)
-	utils.Execute(
-		*execute,
-		"mount",
-		"-o",
-		"X-mount.mkdir",
-		"-t",
-		"zfs",
-		zfsDataSetPathVar,
-		mountPointVar,
-	)
-
-	// Mount the lib dataset.
-	log.Printf("Mounting %s to %s.\n", zfsDataSetPathLib, mountPointLib)
-	utils.Execute(
-		*execute,
-		"mount",
-		"-o",
-		"X-mount.mkdir",
-		"-t",
-		"zfs",
-		zfsDataSetPathLib,
-		mountPointLib,
-	)
-
-	// Mount the docker dataset.
-	log.Printf("Mounting %s to %s.\n", zfsDataSetPathDocker, mountPointDocker)
-	utils.Execute(
-		*execute,
-		"mount",
-		"-o",
-		"X-mount.mkdir",
-		"-t",
-		"zfs",
-		zfsDataSetPathDocker,
-		mountPointDocker,
-	)
-
-	// Mount the tmp dataset.
-	log.Printf("Mounting %s to %s.\n", zfsDataSetPathTmp, mountPointTmp)
-	utils.Execute(
-		*execute,
-		"mount",
-		"-o",
-		"X-mount.mkdir",
-		"-t",
-		"zfs",
-		zfsDataSetPathTmp,
-		mountPointTmp,
-	)
-
-	/*
-		##################################################
-			NixOS
-		##################################################
-	*/
-
-	// Generate the NixOS configuration.
-	log.Println("Generating NixOS configuration.")
-	utils.Execute(
-		*execute,
-		"nixos-generate-config",
-		"--root",
-		mountPoint,
-	)
-
-	// Read the default NixOS configuration.
-	if !*execute {
-		log.Println("Dry run, skipping NixOS configuration modification...")
-	} else {
-		nixOSConfigPath := path.Join(mountPoint, "etc/nixos/configuration.nix")
-
-		// #nosec G304
-		nixOSConfigDefault, err := os.ReadFile(nixOSConfigPath)
-		validate.Error(err)
-
-		// Replace the networking.hostId with the one from the config if provided.
-		// Otherwise it will be generated
-		var nixOSHostIDString string
-		if configData.NixOS.HostID != "" {
-			// Use the user provided host id.
-			nixOSHostIDString = configData.NixOS.HostID
-		} else {
-			// Use the first 8 characters of the machine id.
-			nixOSHostIDString = utils.ExecuteStdOut(
-				*execute,
-				"head",
-				"-c",
-				"8",
-				"/etc/machine-id",
-			)
-		}
-		regex := regexp.MustCompile("\n{\n")
-		nixOSHostID := fmt.Sprintf("  networking.hostId = \"%s\";\n", nixOSHostIDString)
-		nixOSConfigNew := regex.ReplaceAllString(string(nixOSConfigDefault), "\n{\n"+nixOSHostID+"\n")
-
-		// Write the new NixOS configuration with 0600 permissions.
-		err = os.WriteFile(
-			nixOSConfigPath,
-			[]byte(nixOSConfigNew),
-			os.FileMode(0600),
-		)
-		validate.Error(err)
-	}
-
-	// Install NixOS.
-	if *executeInstall {
-		log.Println("Installing NixOS...")
-		utils.Execute(
-			*execute,
-			"nixos-install",
-			"--verbose",
-			"--root",
-			mountPoint,
-			"--impure",
-			"--flake",
-			configData.NixOS.Flake,
-		)
-	} else {
-		fmt.Println("")
-		fmt.Println("You can now edit the NixOS configuration and install NixOS by running:")
-		fmt.Println("")
-		fmt.Println("export NIXPKGS_ALLOW_UNFREE=1")
-		fmt.Printf("sudo -E nixos-install --verbose --root %s --impure --flake %s\n", mountPoint, configData.NixOS.Flake)
-		fmt.Println("")
-		fmt.Println("If needed, remember you can re-run the nixos-install command after making additional changes before rebooting.")
-		fmt.Println("")
-		if configData.NixOS.Config.Enabled {
-			fmt.Printf("TIP: When using the NixOS config partition, it's a good idea to copy your flake locally to %s\n", mountPointNixOSConfig)
-		}
-		fmt.Println("")
-		fmt.Println("REMINDER: Ensure the disk IDs are correctly set in the hardware-configuration.nix file!")
-		fmt.Println("")
-	}
+}
 
+// usage function will print the flags and commands.
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [command]\n\n", os.Args[0])
+	fmt.Fprintln(flag.CommandLine.Output(), "Commands:")
+	fmt.Fprintln(flag.CommandLine.Output(), "  (none)\tPartition, format and mount the disks for a fresh install.")
+	fmt.Fprintf(flag.CommandLine.Output(), "  %s\tCreate missing datasets and fix drifted properties on an existing pool.\n", commandReconcile)
+	fmt.Fprintf(flag.CommandLine.Output(), "  %s\t\tInstall into a new boot environment on an existing pool.\n", commandBootEnv)
+	fmt.Fprintf(flag.CommandLine.Output(), "  %s\t\tImport, unlock and mount an existing install without modifying it.\n", commandMount)
+	fmt.Fprintf(flag.CommandLine.Output(), "  %s\tUnmount the target, turn off swap and export the pools.\n", commandTeardown)
+	fmt.Fprintln(flag.CommandLine.Output(), "")
+	fmt.Fprintln(flag.CommandLine.Output(), "Flags:")
+	flag.PrintDefaults()
 }
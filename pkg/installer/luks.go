@@ -0,0 +1,150 @@
+// Package installer contains the logic for installing NixOS.
+// This file contains the logic for LUKS encryption under the pool.
+package installer
+
+import (
+	"fmt"
+	"path"
+
+	config "github.com/MAHDTech/nixos-installer/pkg/config"
+	events "github.com/MAHDTech/nixos-installer/pkg/events"
+	logger "github.com/MAHDTech/nixos-installer/pkg/logger"
+	utils "github.com/MAHDTech/nixos-installer/pkg/utils"
+)
+
+// luksDevice is a pool device wrapped in LUKS.
+type luksDevice struct {
+	// Device is the partition or disk holding the LUKS header.
+	Device string
+
+	// Name is the device mapper name of the opened device.
+	Name string
+}
+
+// mapperPath function will return the path of the opened device.
+func (device luksDevice) mapperPath() string {
+	return path.Join("/dev/mapper", device.Name)
+}
+
+// luksEnabled function will return true if the pool is built on LUKS devices.
+func luksEnabled(configData config.Config) bool {
+	return configData.ZFS.Pool.Encryption && configData.ZFS.Pool.EncryptionMode == config.EncryptionLUKS
+}
+
+// zfsNativeEncryption function will return true if the pool uses native ZFS encryption.
+func zfsNativeEncryption(configData config.Config) bool {
+	return configData.ZFS.Pool.Encryption && configData.ZFS.Pool.EncryptionMode == config.EncryptionZFS
+}
+
+// luksDevices function will return the LUKS devices for the pool, named after the pool.
+func luksDevices(configData config.Config) []luksDevice {
+
+	devices := []luksDevice{}
+	for i, device := range zfsPoolDevices(configData) {
+		devices = append(devices, luksDevice{
+			Device: device,
+			Name:   fmt.Sprintf("%s-luks%d", configData.ZFS.Pool.Name, i+1),
+		})
+	}
+
+	return devices
+
+}
+
+// zpoolVdevDevices function will return the devices the pool is created on.
+func zpoolVdevDevices(configData config.Config) []string {
+
+	if !luksEnabled(configData) {
+		return zfsPoolDevices(configData)
+	}
+
+	devices := []string{}
+	for _, device := range luksDevices(configData) {
+		devices = append(devices, device.mapperPath())
+	}
+
+	return devices
+
+}
+
+// formatLUKS function will format the pool devices with LUKS2 and open them.
+func formatLUKS(execute bool, configData config.Config) {
+
+	for _, device := range luksDevices(configData) {
+		logger.Infof("Formatting %s with LUKS2.\n", device.Device)
+		events.PromptRequired("cryptsetup will ask for the new passphrase of " + device.Device + ".")
+		utils.Execute(
+			execute,
+			"cryptsetup",
+			"luksFormat",
+			"--type",
+			"luks2",
+			"--batch-mode",
+			"--verify-passphrase",
+			device.Device,
+		)
+		recordChange("%s was formatted with LUKS2.", device.Device)
+	}
+
+	openLUKS(execute, configData)
+
+}
+
+// openLUKS function will open the LUKS devices of the pool that are not already open.
+func openLUKS(execute bool, configData config.Config) {
+
+	for _, device := range luksDevices(configData) {
+		if utils.FileExists(device.mapperPath()) {
+			logger.Infof("LUKS device %s is already open.\n", device.Name)
+			continue
+		}
+		logger.Infof("Opening %s as %s.\n", device.Device, device.Name)
+		events.PromptRequired("cryptsetup will ask for the passphrase of " + device.Device + ".")
+		utils.Execute(
+			execute,
+			"cryptsetup",
+			"open",
+			device.Device,
+			device.Name,
+		)
+		registerUndo("Close LUKS device "+device.Name, "cryptsetup", "close", device.Name)
+	}
+
+}
+
+// closeLUKS function will close the LUKS devices of the pool.
+// It returns false if a device could not be closed.
+func closeLUKS(execute bool, configData config.Config) bool {
+
+	clean := true
+	for _, device := range luksDevices(configData) {
+		if execute && !utils.FileExists(device.mapperPath()) {
+			continue
+		}
+		logger.Infof("Closing LUKS device %s.\n", device.Name)
+		err := utils.ExecuteSilent(
+			execute,
+			"cryptsetup",
+			"close",
+			device.Name,
+		)
+		if err != nil {
+			clean = false
+		}
+	}
+
+	return clean
+
+}
+
+// luksSettings function will return the initrd settings to open the LUKS devices on boot.
+func luksSettings(configData config.Config) []string {
+
+	settings := []string{}
+	for _, device := range luksDevices(configData) {
+		settings = append(settings, fmt.Sprintf("boot.initrd.luks.devices.\"%s\".device = \"%s\";", device.Name, device.Device))
+	}
+
+	return settings
+
+}
@@ -0,0 +1,57 @@
+// Package installer contains the logic for installing NixOS.
+// This file contains the logic for mounting the target.
+package installer
+
+import (
+	"path"
+
+	config "github.com/MAHDTech/nixos-installer/pkg/config"
+	logger "github.com/MAHDTech/nixos-installer/pkg/logger"
+	utils "github.com/MAHDTech/nixos-installer/pkg/utils"
+)
+
+// mountTarget function will mount the root filesystem and partitions under the mountpoint.
+func mountTarget(execute bool, configData config.Config, rootFS filesystem) {
+
+	mountPoint := configData.MountPoint
+
+	// Mount the datasets with parents before children.
+	rootFS.mount(execute, configData)
+
+	// Mount the UEFI partition.
+	partitionNameUEFI := partitionName(configData.UEFI.Disk, 1)
+	mountPointUEFI := path.Join(mountPoint, espMountPath(configData))
+	logger.Infof("Mounting %s to %s.\n", partitionNameUEFI, mountPointUEFI)
+	utils.Execute(
+		execute,
+		"mount",
+		"-t",
+		"vfat",
+		"-o",
+		"fmask=0077,dmask=0077,iocharset=iso8859-1,X-mount.mkdir",
+		partitionNameUEFI,
+		mountPointUEFI,
+	)
+	registerUndo("Unmount "+mountPointUEFI, "umount", mountPointUEFI)
+
+	// Mount the NixOS config partition if it is enabled.
+	if configData.NixOS.Config.Enabled {
+		partitionNameNixOSConfig := partitionName(configData.UEFI.Disk, 2)
+		mountPointNixOSConfig := path.Join(mountPoint, "boot/nixos")
+		logger.Infof("Mounting %s to %s.\n", partitionNameNixOSConfig, mountPointNixOSConfig)
+		utils.Execute(
+			execute,
+			"mount",
+			"-o",
+			"X-mount.mkdir",
+			"-t",
+			"xfs",
+			partitionNameNixOSConfig,
+			mountPointNixOSConfig,
+		)
+		registerUndo("Unmount "+mountPointNixOSConfig, "umount", mountPointNixOSConfig)
+	} else {
+		logger.Info("Skipping NixOS config partition mounting as it is disabled.")
+	}
+
+}
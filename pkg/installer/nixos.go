@@ -0,0 +1,130 @@
+// Package installer contains the logic for installing NixOS.
+// This file contains the logic for generating the NixOS configuration.
+package installer
+
+import (
+	"regexp"
+	"strings"
+
+	config "github.com/MAHDTech/nixos-installer/pkg/config"
+)
+
+// The path to the lanzaboote Secure Boot keys on the target.
+const lanzabootePKIBundle = "/var/lib/sbctl"
+
+// espMountPath function will return where the ESP is mounted on the target.
+func espMountPath(configData config.Config) string {
+	if configData.Bootloader.Type == config.BootloaderGRUB {
+		return "/boot/efi"
+	}
+	return "/boot"
+}
+
+// bootOnZFS function will return true if /boot is a ZFS dataset.
+// Otherwise GRUB reads /boot from the root filesystem.
+func bootOnZFS(configData config.Config) bool {
+	return configData.Bootloader.Type == config.BootloaderGRUB && configData.RootFS.Type == config.RootFSZFS
+}
+
+// nixOSSettings function will return the settings matching the installed layout.
+func nixOSSettings(configData config.Config, rootFS filesystem) []string {
+
+	settings := bootloaderSettings(configData)
+
+	return append(settings, rootFS.settings(configData)...)
+
+}
+
+// bootloaderSettings function will return the boot.loader settings for the configured bootloader.
+func bootloaderSettings(configData config.Config) []string {
+
+	settings := []string{}
+
+	switch configData.Bootloader.Type {
+	case config.BootloaderGRUB:
+		settings = append(settings,
+			"boot.loader.grub.enable = true;",
+			"boot.loader.grub.efiSupport = true;",
+		)
+		if bootOnZFS(configData) {
+			settings = append(settings, "boot.loader.grub.zfsSupport = true;")
+		}
+		settings = append(settings, "boot.loader.grub.device = \"nodev\";")
+	case config.BootloaderSystemdBoot:
+		settings = append(settings,
+			"boot.loader.systemd-boot.enable = true;",
+		)
+	case config.BootloaderLanzaboote:
+		// Secure Boot keys must exist before lanzaboote can sign anything,
+		// so install with systemd-boot and leave lanzaboote ready to enable.
+		settings = append(settings,
+			"boot.loader.systemd-boot.enable = true;",
+			"# Enable lanzaboote once the Secure Boot keys exist in "+lanzabootePKIBundle+".",
+			"# boot.loader.systemd-boot.enable = lib.mkForce false;",
+			"# boot.lanzaboote.enable = true;",
+			"# boot.lanzaboote.pkiBundle = \""+lanzabootePKIBundle+"\";",
+		)
+	}
+
+	settings = append(settings,
+		"boot.loader.efi.canTouchEfiVariables = true;",
+		"boot.loader.efi.efiSysMountPoint = \""+espMountPath(configData)+"\";",
+	)
+
+	return settings
+
+}
+
+// updateNixOSConfig function will add the settings to the generated NixOS configuration.
+func updateNixOSConfig(nixOSConfig string, settings []string) string {
+
+	// Comment out the generated bootloader settings as they are replaced.
+	regexBootloader := regexp.MustCompile(`(?m)^(\s*)(boot\.loader\.)`)
+	nixOSConfig = regexBootloader.ReplaceAllString(nixOSConfig, "$1# $2")
+
+	// Insert the settings at the top of the configuration.
+	var block strings.Builder
+	for _, setting := range settings {
+		block.WriteString("  " + setting + "\n")
+	}
+	regex := regexp.MustCompile("\n{\n")
+
+	return regex.ReplaceAllLiteralString(nixOSConfig, "\n{\n"+block.String()+"\n")
+
+}
+
+// impermanenceSettings function will return the settings to roll back the root dataset on boot.
+func impermanenceSettings(configData config.Config, datasets []zfsDataset) []string {
+
+	// The rollback runs in the initrd after the pool is imported and before the root is mounted.
+	rollback := "zfs rollback -r " + rootDataset(datasets).Path + "@" + zfsSnapshotBlank
+	settings := []string{
+		"boot.initrd.postDeviceCommands = lib.mkAfter ''",
+		"  " + rollback,
+		"'';",
+	}
+	if systemdInitrd(configData) {
+		settings = []string{
+			"boot.initrd.systemd.services.rollback = {",
+			"  description = \"Roll back the root dataset to a blank snapshot\";",
+			"  wantedBy = [ \"initrd.target\" ];",
+			"  after = [ \"zfs-import-" + configData.ZFS.Pool.Name + ".service\" ];",
+			"  before = [ \"sysroot.mount\" ];",
+			"  path = [ config.boot.zfs.package ];",
+			"  unitConfig.DefaultDependencies = \"no\";",
+			"  serviceConfig.Type = \"oneshot\";",
+			"  script = \"" + rollback + "\";",
+			"};",
+		}
+	}
+
+	// The persistent datasets must be mounted before impermanence links them.
+	for _, dataset := range configData.ZFS.Datasets {
+		if strings.HasPrefix(dataset.Mountpoint, "/persist") {
+			settings = append(settings, "fileSystems.\""+dataset.Mountpoint+"\".neededForBoot = true;")
+		}
+	}
+
+	return settings
+
+}
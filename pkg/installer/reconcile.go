@@ -0,0 +1,191 @@
+// Package installer contains the logic for installing NixOS.
+// This file contains the logic for reconciling an existing pool.
+package installer
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	config "github.com/MAHDTech/nixos-installer/pkg/config"
+	logger "github.com/MAHDTech/nixos-installer/pkg/logger"
+	utils "github.com/MAHDTech/nixos-installer/pkg/utils"
+)
+
+// datasetChange is a difference between the layout and an existing pool.
+type datasetChange struct {
+	// Dataset is the dataset from the layout.
+	Dataset zfsDataset
+
+	// Create is true when the dataset does not exist.
+	Create bool
+
+	// Property is the drifted property, e.g. atime=off.
+	Property string
+
+	// Actual is the current value of the drifted property.
+	Actual string
+}
+
+// String function will return the change in a diff like format.
+func (change datasetChange) String() string {
+	if change.Create {
+		return fmt.Sprintf("+ %s (%s)", change.Dataset.Path, strings.Join(change.Dataset.Properties, ", "))
+	}
+	return fmt.Sprintf("~ %s %s (currently %s)", change.Dataset.Path, change.Property, change.Actual)
+}
+
+// reconcile function will bring an existing pool in line with the layout without destroying data.
+func reconcile(execute bool, configData config.Config) {
+
+	// A dry run only reads the pools that are already imported, importing them would change the system.
+	importedPools := []string{}
+	if execute {
+		importedPools = importPools(execute, configData)
+	} else {
+		for _, pool := range zfsPools(configData) {
+			if !zfsPoolImported(pool) {
+				logger.Fatalf("ZFS pool %s is not imported, a dry run only compares imported pools. Import it with 'zpool import -N %s' or use -run.\n", pool, pool)
+			}
+		}
+	}
+
+	// Compare the layout with the datasets that exist.
+	changes, unmanaged := datasetChanges(zfsDatasets(configData))
+
+	fmt.Println("")
+	if len(changes) == 0 {
+		fmt.Println("The ZFS datasets match the configuration.")
+	}
+	for _, change := range changes {
+		fmt.Println(change)
+	}
+	for _, dataset := range unmanaged {
+		fmt.Printf("? %s (not in the configuration, left untouched)\n", dataset)
+	}
+	fmt.Println("")
+
+	// Apply the changes.
+	created := []zfsDataset{}
+	for _, change := range changes {
+		if change.Create {
+			logger.Infof("Creating dataset %s\n", change.Dataset.Path)
+			utils.Execute(
+				execute,
+				"zfs",
+				change.Dataset.createArgs(zfsEncryptionArgs(configData, "-o", false))...,
+			)
+			if change.Dataset.mounted() {
+				created = append(created, change.Dataset)
+			}
+		} else if strings.HasPrefix(change.Property, "mountpoint=") && datasetMounted(change.Dataset.Path) {
+			// Changing the mountpoint unmounts the dataset, e.g. the root of the running system.
+			logger.Warnf("Skipping %s on %s as it is mounted, set it once it is not in use.\n", change.Property, change.Dataset.Path)
+		} else {
+			logger.Infof("Setting %s on %s\n", change.Property, change.Dataset.Path)
+			utils.Execute(
+				execute,
+				"zfs",
+				"set",
+				change.Property,
+				change.Dataset.Path,
+			)
+		}
+	}
+
+	// Export the pools again if they were imported here.
+	for _, pool := range importedPools {
+		logger.Infof("Exporting ZFS pool %s.\n", pool)
+		utils.Execute(
+			true,
+			"zpool",
+			"export",
+			pool,
+		)
+	}
+
+	// Close the LUKS devices opened for the import.
+	if luksEnabled(configData) && slices.Contains(importedPools, configData.ZFS.Pool.Name) {
+		closeLUKS(true, configData)
+	}
+
+	// The pools were exported, nothing is left to undo.
+	clearUndo()
+
+	// New datasets must also be added to the NixOS configuration.
+	if len(created) > 0 {
+		fmt.Println("")
+		fmt.Println("Add the new datasets to the NixOS configuration:")
+		fmt.Println("")
+		for _, dataset := range created {
+			fmt.Printf("fileSystems.\"%s\" = { device = \"%s\"; fsType = \"zfs\"; };\n", dataset.Mountpoint, dataset.Path)
+		}
+		fmt.Println("")
+	}
+
+}
+
+// datasetMounted function will return true if the dataset is currently mounted.
+func datasetMounted(dataset string) bool {
+	mounted, err := utils.Query("zfs", "get", "-H", "-o", "value", "mounted", dataset)
+	return err == nil && strings.TrimSpace(mounted) == "yes"
+}
+
+// datasetChanges function will return the changes needed and the datasets not in the layout.
+func datasetChanges(datasets []zfsDataset) ([]datasetChange, []string) {
+
+	// List the datasets that currently exist in the pools.
+	existing := existingDatasets(datasets)
+	pools := map[string]bool{}
+	for _, dataset := range datasets {
+		pools[datasetPool(dataset)] = true
+	}
+
+	changes := []datasetChange{}
+	managed := map[string]bool{}
+	for _, dataset := range datasetCreateOrder(datasets) {
+		managed[dataset.Path] = true
+
+		if !existing[dataset.Path] {
+			changes = append(changes, datasetChange{Dataset: dataset, Create: true})
+			continue
+		}
+
+		for _, property := range dataset.Properties {
+			name, value, _ := strings.Cut(property, "=")
+			actual, err := utils.Query("zfs", "get", "-H", "-o", "value", name, dataset.Path)
+			if err != nil {
+				logger.Warnf("Unable to get %s on %s: %s\n", name, dataset.Path, err)
+				continue
+			}
+			actual = strings.TrimSpace(actual)
+			if actual != value {
+				changes = append(changes, datasetChange{Dataset: dataset, Property: property, Actual: actual})
+			}
+		}
+	}
+
+	// Report the datasets that are not managed, ignoring the pools and their parents.
+	unmanaged := []string{}
+	for name := range existing {
+		if managed[name] || pools[name] || isParentDataset(name, managed) {
+			continue
+		}
+		unmanaged = append(unmanaged, name)
+	}
+	sort.Strings(unmanaged)
+
+	return changes, unmanaged
+
+}
+
+// isParentDataset function will return true if the dataset is a parent of a managed dataset.
+func isParentDataset(name string, managed map[string]bool) bool {
+	for managedName := range managed {
+		if strings.HasPrefix(managedName, name+"/") {
+			return true
+		}
+	}
+	return false
+}
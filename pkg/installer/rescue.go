@@ -0,0 +1,51 @@
+// Package installer contains the logic for installing NixOS.
+// This file contains the logic for mounting an existing install.
+package installer
+
+import (
+	"fmt"
+	"os"
+
+	config "github.com/MAHDTech/nixos-installer/pkg/config"
+	events "github.com/MAHDTech/nixos-installer/pkg/events"
+	logger "github.com/MAHDTech/nixos-installer/pkg/logger"
+	utils "github.com/MAHDTech/nixos-installer/pkg/utils"
+)
+
+// rescue function will import and mount an existing install without modifying it.
+func rescue(execute bool, configData config.Config, enter bool) {
+
+	mountPoint := configData.MountPoint
+
+	// Import the pools and unlock the encryption.
+	rootFS := newFilesystem(configData, false)
+	rootFS.open(execute, configData)
+
+	// Mount the full tree under the mountpoint.
+	logger.Info("Mounting directories.")
+	mountTarget(execute, configData, rootFS)
+
+	// Drop into the installed system if requested.
+	if enter {
+		logger.Infof("Entering the NixOS install at %s.\n", mountPoint)
+		events.PromptRequired("nixos-enter is waiting for input on the console.")
+		utils.Execute(
+			execute,
+			"nixos-enter",
+			"--root",
+			mountPoint,
+		)
+		return
+	}
+
+	fmt.Println("")
+	fmt.Printf("The existing install is mounted at %s, you can enter it by running:\n", mountPoint)
+	fmt.Println("")
+	fmt.Printf("sudo nixos-enter --root %s\n", mountPoint)
+	fmt.Println("")
+	fmt.Printf("When finished, unmount it by running:\n")
+	fmt.Println("")
+	fmt.Printf("sudo %s -config <config> -run %s\n", os.Args[0], commandTeardown)
+	fmt.Println("")
+
+}
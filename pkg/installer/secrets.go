@@ -0,0 +1,165 @@
+// Package installer contains the logic for installing NixOS.
+// This file contains the logic for provisioning secrets onto the target.
+package installer
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	config "github.com/MAHDTech/nixos-installer/pkg/config"
+	events "github.com/MAHDTech/nixos-installer/pkg/events"
+	logger "github.com/MAHDTech/nixos-installer/pkg/logger"
+	utils "github.com/MAHDTech/nixos-installer/pkg/utils"
+	validate "github.com/MAHDTech/nixos-installer/pkg/validate"
+)
+
+// The SSH host key types NixOS generates by default.
+var sshHostKeyTypes = [][]string{
+	{"ed25519"},
+	{"rsa", "-b", "4096"},
+}
+
+// The host key used by sops-nix and agenix.
+const sshHostKeyEd25519 = "ssh_host_ed25519_key"
+
+// provisionSecrets function will copy or generate the SSH host keys and age key on the target.
+// When waiting, it pauses after printing the age public keys so the secrets can be re-encrypted.
+func provisionSecrets(execute bool, configData config.Config, wait bool) {
+
+	mountPointHostKeys := path.Join(configData.MountPoint, configData.Secrets.SSHHostKeysPath)
+	logger.Infof("Creating the SSH host key directory %s\n", mountPointHostKeys)
+	utils.Execute(
+		execute,
+		"mkdir",
+		"-p",
+		mountPointHostKeys,
+	)
+
+	// Copy the existing host keys, otherwise generate new ones.
+	if configData.Secrets.SSHHostKeys != "" {
+		entries, err := os.ReadDir(configData.Secrets.SSHHostKeys)
+		validate.Panic(err)
+		for _, entry := range entries {
+			if entry.IsDir() || !strings.HasPrefix(entry.Name(), "ssh_host_") {
+				continue
+			}
+			// Only the public keys are readable by everyone.
+			mode := "0600"
+			if strings.HasSuffix(entry.Name(), ".pub") {
+				mode = "0644"
+			}
+			logger.Infof("Copying SSH host key %s\n", entry.Name())
+			utils.Execute(
+				execute,
+				"install",
+				"-m",
+				mode,
+				path.Join(configData.Secrets.SSHHostKeys, entry.Name()),
+				path.Join(mountPointHostKeys, entry.Name()),
+			)
+		}
+	} else {
+		for _, keyType := range sshHostKeyTypes {
+			keyPath := path.Join(mountPointHostKeys, "ssh_host_"+keyType[0]+"_key")
+			logger.Infof("Generating SSH host key %s\n", keyPath)
+			args := []string{"-q", "-t"}
+			args = append(args, keyType...)
+			args = append(args, "-N", "", "-C", "", "-f", keyPath)
+			utils.Execute(
+				execute,
+				"ssh-keygen",
+				args...,
+			)
+		}
+	}
+
+	// Copy or generate the age key.
+	mountPointAgeKey := path.Join(configData.MountPoint, configData.Secrets.AgeKey.Path)
+	if configData.Secrets.AgeKey.Enabled {
+		utils.Execute(
+			execute,
+			"mkdir",
+			"-p",
+			path.Dir(mountPointAgeKey),
+		)
+		if configData.Secrets.AgeKey.Source != "" {
+			logger.Infof("Copying age key to %s\n", mountPointAgeKey)
+			utils.Execute(
+				execute,
+				"install",
+				"-m",
+				"0600",
+				configData.Secrets.AgeKey.Source,
+				mountPointAgeKey,
+			)
+		} else {
+			logger.Infof("Generating age key %s\n", mountPointAgeKey)
+			utils.Execute(
+				execute,
+				"age-keygen",
+				"-o",
+				mountPointAgeKey,
+			)
+		}
+	}
+
+	if !execute {
+		logger.Info("DRY RUN: Skipping the age public keys.")
+		return
+	}
+
+	// The recipients to add to .sops.yaml or secrets.nix.
+	recipients := []string{}
+	sshPublicKey := path.Join(mountPointHostKeys, sshHostKeyEd25519+".pub")
+	if utils.FileExists(sshPublicKey) {
+		recipient, err := utils.Query("ssh-to-age", "-i", sshPublicKey)
+		if err != nil {
+			logger.Warnf("Unable to convert %s to an age public key: %s\n", sshPublicKey, err)
+		} else {
+			recipients = append(recipients, fmt.Sprintf("%s (from the SSH host key)", strings.TrimSpace(recipient)))
+		}
+
+		// #nosec G304
+		publicKey, err := os.ReadFile(sshPublicKey)
+		if err == nil {
+			recipients = append(recipients, fmt.Sprintf("%s (SSH host key, for agenix)", strings.TrimSpace(string(publicKey))))
+		}
+	}
+	if configData.Secrets.AgeKey.Enabled {
+		recipient, err := utils.Query("age-keygen", "-y", mountPointAgeKey)
+		if err != nil {
+			logger.Warnf("Unable to read the age public key from %s: %s\n", mountPointAgeKey, err)
+		} else {
+			recipients = append(recipients, fmt.Sprintf("%s (from the age key)", strings.TrimSpace(recipient)))
+		}
+	}
+
+	fmt.Println("")
+	fmt.Println("Add the public keys of this host to .sops.yaml or secrets.nix and re-encrypt the secrets:")
+	fmt.Println("")
+	for _, recipient := range recipients {
+		fmt.Printf("  %s\n", recipient)
+		logger.Infof("Host public key %s\n", recipient)
+	}
+	fmt.Println("")
+
+	// Wait until the secrets have been re-encrypted and pushed.
+	if wait && configData.Secrets.Wait {
+		events.PromptRequired("Waiting for the secrets to be re-encrypted, press Enter on the console to continue.")
+		fmt.Print("Press Enter once the secrets have been re-encrypted and pushed to continue the install...")
+		_, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		validate.Panic(err)
+
+		// The copy of the flake source was made before the secrets were re-encrypted.
+		if configData.NixOS.Config.Source != "" {
+			refreshFlakeSource(execute, configData)
+		}
+		if installMode(configData) != installModeSystem {
+			refreshFlake(execute, configData)
+		}
+	}
+
+}
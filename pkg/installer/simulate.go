@@ -0,0 +1,88 @@
+// Package installer contains the logic for installing NixOS.
+// This file contains the logic for simulating a dry run.
+package installer
+
+import (
+	"fmt"
+	"strings"
+
+	config "github.com/MAHDTech/nixos-installer/pkg/config"
+	logger "github.com/MAHDTech/nixos-installer/pkg/logger"
+	simulate "github.com/MAHDTech/nixos-installer/pkg/simulate"
+	utils "github.com/MAHDTech/nixos-installer/pkg/utils"
+)
+
+// The highest partition number checked on the existing disks.
+const simulatePartitionsMax = 9
+
+// startSimulation function will model the current disks, pools, datasets and mounts for a dry run.
+func startSimulation(configData config.Config) {
+
+	simulate.Start()
+
+	// Only the configured disks are modelled, other devices are assumed to exist.
+	disks := append([]string{configData.UEFI.Disk}, config.RootDisks(configData)...)
+	for _, disk := range disks {
+		partitions := []int{}
+		for number := 1; number <= simulatePartitionsMax; number++ {
+			if utils.FileExists(partitionName(disk, number)) {
+				partitions = append(partitions, number)
+			}
+		}
+		simulate.AddDisk(disk, partitions)
+	}
+
+	// Only ZFS has pools and datasets to model.
+	if configData.RootFS.Type == config.RootFSZFS {
+		startSimulationPools()
+	}
+
+	startSimulationMounts()
+
+}
+
+// startSimulationPools function will model the imported pools and their datasets.
+func startSimulationPools() {
+
+	output, err := utils.Query("zpool", "list", "-H", "-o", "name")
+	if err != nil {
+		logger.Warnf("Unable to list the ZFS pools for the simulation: %s", err)
+	}
+	for _, pool := range strings.Fields(output) {
+		simulate.AddPool(pool, true)
+	}
+	output, err = utils.Query("zfs", "list", "-H", "-o", "name", "-t", "filesystem,volume")
+	if err != nil {
+		logger.Warnf("Unable to list the ZFS datasets for the simulation: %s", err)
+	}
+	for _, dataset := range strings.Fields(output) {
+		simulate.AddDataset(dataset)
+	}
+
+}
+
+// startSimulationMounts function will model the current mounts.
+func startSimulationMounts() {
+
+	mounts, err := readMounts()
+	if err != nil {
+		logger.Warnf("Unable to read the current mountpoints for the simulation: %s", err)
+	}
+	for _, mount := range mounts {
+		simulate.AddMount(mount.Device, mount.Mountpoint)
+	}
+
+}
+
+// printSimulation function will print the predicted state after a dry run.
+func printSimulation(configData config.Config) {
+
+	fmt.Println("")
+	fmt.Println("DRY RUN: The predicted state after running for real:")
+	fmt.Println("")
+	for _, line := range simulate.Summary(configData.MountPoint) {
+		fmt.Printf("  %s\n", line)
+	}
+	fmt.Println("")
+
+}
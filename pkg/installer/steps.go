@@ -0,0 +1,134 @@
+// Package installer contains the logic for installing NixOS.
+// This file contains the logic for the installer steps.
+package installer
+
+import (
+	"fmt"
+
+	events "github.com/MAHDTech/nixos-installer/pkg/events"
+	logger "github.com/MAHDTech/nixos-installer/pkg/logger"
+	utils "github.com/MAHDTech/nixos-installer/pkg/utils"
+)
+
+// The names of the installer steps reported in the progress events.
+const (
+	stepPreflight   = "preflight"
+	stepPrebuild    = "prebuild"
+	stepDirectories = "directories"
+	stepUEFI        = "uefi"
+	stepPools       = "pools"
+	stepFilesystem  = "filesystem"
+	stepBootEnv     = "bootenv"
+	stepDatasets    = "datasets"
+	stepMount       = "mount"
+	stepFlake       = "flake"
+	stepNixOSConfig = "nixos-config"
+	stepUnlock      = "unlock"
+	stepSecrets     = "secrets"
+	stepInstall     = "install"
+	stepSnapshots   = "snapshots"
+	stepTeardown    = "teardown"
+	stepReconcile   = "reconcile"
+)
+
+// beginStep function will report the start of a step and return the function that finishes it.
+func beginStep(name string) func() {
+	logger.Debugf("Starting step %s", name)
+	currentStep = name
+	events.StepStarted(name)
+	return func() {
+		events.StepFinished(name)
+		logger.Debugf("Finished step %s", name)
+	}
+}
+
+// undoAction is a command that compensates for a change made by a step.
+type undoAction struct {
+	Step        string
+	Description string
+	CmdName     string
+	Args        []string
+}
+
+// The rollback state of the current run.
+var (
+	currentStep string
+	undoActions []undoAction
+	changes     []string
+)
+
+// registerUndo function will add a compensating action for a change that was just made.
+func registerUndo(description string, cmdName string, args ...string) {
+	undoActions = append(undoActions, undoAction{
+		Step:        currentStep,
+		Description: description,
+		CmdName:     cmdName,
+		Args:        args,
+	})
+}
+
+// dropUndo function will forget the last undo action with the description once the step reverted the change itself.
+func dropUndo(description string) {
+	for i := len(undoActions) - 1; i >= 0; i-- {
+		if undoActions[i].Description == description {
+			undoActions = append(undoActions[:i], undoActions[i+1:]...)
+			return
+		}
+	}
+}
+
+// recordChange function will note a change that can't be undone, e.g. zapping a disk.
+func recordChange(format string, args ...any) {
+	changes = append(changes, fmt.Sprintf(format, args...))
+}
+
+// clearUndo function will forget the undo actions once the changes must be kept.
+// The changes that can't be undone are kept for the summary of a later failure.
+func clearUndo() {
+	undoActions = nil
+}
+
+// rollback function will run the undo actions in reverse and summarise the state of the disks.
+func rollback(execute bool, failure any) {
+
+	logger.Errorf("The installer failed during the '%s' step: %v", currentStep, failure)
+
+	results := []string{}
+	for i := len(undoActions) - 1; i >= 0; i-- {
+		action := undoActions[i]
+		logger.Infof("Rolling back: %s", action.Description)
+		err := utils.ExecuteSilent(
+			execute,
+			action.CmdName,
+			action.Args...,
+		)
+		if err != nil {
+			results = append(results, fmt.Sprintf("  FAILED  %s (from %s: %s)", action.Description, action.Step, err))
+		} else {
+			results = append(results, fmt.Sprintf("  OK      %s (from %s)", action.Description, action.Step))
+		}
+	}
+
+	fmt.Println("")
+	fmt.Printf("The installer failed during the '%s' step: %v\n", currentStep, failure)
+	fmt.Println("")
+	if len(results) > 0 {
+		fmt.Println("Rolled back:")
+		for _, result := range results {
+			fmt.Println(result)
+		}
+		fmt.Println("")
+	}
+	if len(changes) > 0 {
+		fmt.Println("Left as is:")
+		for _, change := range changes {
+			fmt.Printf("  %s\n", change)
+		}
+		fmt.Println("")
+	}
+	if len(results) == 0 && len(changes) == 0 {
+		fmt.Println("No changes were made to the disks.")
+		fmt.Println("")
+	}
+
+}
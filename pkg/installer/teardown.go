@@ -0,0 +1,161 @@
+// Package installer contains the logic for installing NixOS.
+// This file contains the logic for tearing down the target.
+package installer
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	config "github.com/MAHDTech/nixos-installer/pkg/config"
+	logger "github.com/MAHDTech/nixos-installer/pkg/logger"
+	utils "github.com/MAHDTech/nixos-installer/pkg/utils"
+)
+
+// teardown function will unmount the target and release the root filesystem.
+// It returns false if anything was left behind.
+func teardown(execute bool, configData config.Config) bool {
+
+	clean := true
+	busy := map[string][]string{}
+
+	// Unmount the children before their parents.
+	mountpoints, err := mountpointsUnder(configData.MountPoint)
+	if err != nil {
+		logger.Warnf("Unable to read the current mountpoints: %s\n", err)
+	}
+	for _, mountpoint := range mountpoints {
+		logger.Infof("Unmounting %s.\n", mountpoint)
+		err := utils.ExecuteSilent(
+			execute,
+			"umount",
+			mountpoint,
+		)
+		if err != nil {
+			// Find out what is keeping the mountpoint busy.
+			busy[mountpoint] = utils.ProcessesUsing(mountpoint)
+			clean = false
+		}
+	}
+
+	// Release the root filesystem, e.g. export the pools.
+	if !newFilesystem(configData, false).release(execute, configData) {
+		clean = false
+	}
+
+	// Report what was left behind.
+	if len(busy) > 0 {
+		fmt.Println("")
+		fmt.Println("The following mountpoints are busy:")
+		for _, mountpoint := range mountpoints {
+			processes, ok := busy[mountpoint]
+			if !ok {
+				continue
+			}
+			fmt.Printf("  %s\n", mountpoint)
+			if len(processes) == 0 {
+				fmt.Println("    (no processes found)")
+			}
+			for _, process := range processes {
+				fmt.Printf("    %s\n", process)
+			}
+		}
+		fmt.Println("")
+	}
+	if !clean {
+		logger.Warn("Teardown was incomplete.")
+	}
+
+	return clean
+
+}
+
+// mountEntry is a line from /proc/self/mounts.
+type mountEntry struct {
+	Device     string
+	Mountpoint string
+	Type       string
+}
+
+// readMounts function will return the current mounts in the order they were mounted.
+func readMounts() ([]mountEntry, error) {
+
+	file, err := os.Open("/proc/self/mounts")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	mounts := []mountEntry{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 {
+			continue
+		}
+		// Spaces in mountpoints are escaped as octal.
+		mounts = append(mounts, mountEntry{
+			Device:     fields[0],
+			Mountpoint: strings.ReplaceAll(fields[1], "\\040", " "),
+			Type:       fields[2],
+		})
+	}
+
+	return mounts, scanner.Err()
+
+}
+
+// isUnder function will return true if the path is the root or below it.
+func isUnder(target string, root string) bool {
+	return target == root || strings.HasPrefix(target, root+"/")
+}
+
+// zfsPoolInUse function will return true if the pool has mounts outside of the mountpoint.
+func zfsPoolInUse(pool string, mountPoint string) bool {
+
+	mounts, err := readMounts()
+	if err != nil {
+		return false
+	}
+
+	for _, mount := range mounts {
+		if mount.Type != "zfs" || isUnder(mount.Mountpoint, mountPoint) {
+			continue
+		}
+		if mount.Device == pool || strings.HasPrefix(mount.Device, pool+"/") {
+			return true
+		}
+	}
+
+	return false
+
+}
+
+// mountpointsUnder function will return the mountpoints under a path, deepest first.
+func mountpointsUnder(root string) ([]string, error) {
+
+	mounts, err := readMounts()
+	if err != nil {
+		return nil, err
+	}
+
+	mountpoints := []string{}
+	for _, mount := range mounts {
+		if isUnder(mount.Mountpoint, root) {
+			mountpoints = append(mountpoints, mount.Mountpoint)
+		}
+	}
+
+	// Reverse the mount order so children are unmounted first.
+	for i, j := 0, len(mountpoints)-1; i < j; i, j = i+1, j-1 {
+		mountpoints[i], mountpoints[j] = mountpoints[j], mountpoints[i]
+	}
+	sort.SliceStable(mountpoints, func(i, j int) bool {
+		return mountDepth(mountpoints[i]) > mountDepth(mountpoints[j])
+	})
+
+	return mountpoints, nil
+
+}
@@ -0,0 +1,205 @@
+// Package installer contains the logic for installing NixOS.
+// This file contains the logic for unlocking the encrypted pool with a TPM2 or FIDO2 token.
+package installer
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	config "github.com/MAHDTech/nixos-installer/pkg/config"
+	events "github.com/MAHDTech/nixos-installer/pkg/events"
+	logger "github.com/MAHDTech/nixos-installer/pkg/logger"
+	utils "github.com/MAHDTech/nixos-installer/pkg/utils"
+	validate "github.com/MAHDTech/nixos-installer/pkg/validate"
+)
+
+// The TPM2 resource manager device.
+const tpm2Device = "/dev/tpmrm0"
+
+// The directory on the target holding the sealed ZFS key, it is copied into the initrd.
+const unlockSecretsPath = "/etc/secrets/initrd"
+
+// unlockEnrolled function will return true if a TPM2 or FIDO2 token unlocks the pool.
+func unlockEnrolled(configData config.Config) bool {
+	return configData.ZFS.Pool.Unlock.Method == config.UnlockTPM2 || configData.ZFS.Pool.Unlock.Method == config.UnlockFIDO2
+}
+
+// systemdInitrd function will return true if the initrd must be systemd based.
+// The LUKS tokens enrolled by systemd-cryptenroll are only read by systemd-cryptsetup.
+func systemdInitrd(configData config.Config) bool {
+	return luksEnabled(configData) && unlockEnrolled(configData)
+}
+
+// zfsKeySealed function will return true if the native ZFS key is sealed to the TPM2.
+func zfsKeySealed(configData config.Config) bool {
+	return zfsNativeEncryption(configData) && configData.ZFS.Pool.Unlock.Method == config.UnlockTPM2
+}
+
+// zfsKeyFile function will return the temporary path of the generated ZFS key.
+func zfsKeyFile(configData config.Config) string {
+	return path.Join(os.TempDir(), "nixos-installer-"+configData.ZFS.Pool.Name+".key")
+}
+
+// zfsSealedKeyPath function will return the path of the sealed ZFS key on the installed system.
+func zfsSealedKeyPath(configData config.Config) string {
+	persist := ""
+	if configData.ZFS.Impermanence.Enabled {
+		persist = "/persist"
+	}
+	return path.Join(persist, unlockSecretsPath, configData.ZFS.Pool.Name+".jwe")
+}
+
+// checkUnlock function will check the TPM2 or FIDO2 token is present before anything is changed.
+func checkUnlock(configData config.Config) error {
+
+	switch configData.ZFS.Pool.Unlock.Method {
+	case config.UnlockTPM2:
+		logger.Infof("Checking for a TPM2 at %s\n", tpm2Device)
+		if !utils.FileExists(tpm2Device) {
+			return errors.New("tpm2 unlock is configured but " + tpm2Device + " does not exist")
+		}
+	case config.UnlockFIDO2:
+		logger.Info("Checking for a FIDO2 token")
+		_, err := utils.Query("systemd-cryptenroll", "--fido2-device=list")
+		if err != nil {
+			return fmt.Errorf("fido2 unlock is configured but no FIDO2 token was found: %w", err)
+		}
+	}
+
+	return nil
+
+}
+
+// createZFSKey function will generate a random key for the pool and write it to a temporary file.
+// The key is sealed to the TPM2 once the target is mounted.
+func createZFSKey(execute bool, configData config.Config) {
+
+	keyFile := zfsKeyFile(configData)
+
+	if !execute {
+		logger.Infof("DRY RUN: Would generate the ZFS key %s\n", keyFile)
+		return
+	}
+
+	logger.Infof("Generating the ZFS key %s\n", keyFile)
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	validate.Panic(err)
+
+	err = os.WriteFile(keyFile, []byte(hex.EncodeToString(key)), os.FileMode(0600))
+	validate.Panic(err)
+	registerUndo("Remove the ZFS key "+keyFile, "rm", "-f", keyFile)
+
+}
+
+// enrollUnlock function will enroll the TPM2 or FIDO2 token, or seal the ZFS key to the TPM2.
+// The ZFS key only exists when the pool was created by this run.
+func enrollUnlock(execute bool, configData config.Config, poolCreated bool) {
+
+	// Enroll every LUKS device, replacing an earlier enrollment of the same type.
+	if luksEnabled(configData) {
+		for _, device := range luksDevices(configData) {
+			args := []string{"--wipe-slot=" + configData.ZFS.Pool.Unlock.Method}
+			if configData.ZFS.Pool.Unlock.Method == config.UnlockTPM2 {
+				args = append(args, "--tpm2-device=auto", "--tpm2-pcrs="+configData.ZFS.Pool.Unlock.PCRs)
+				logger.Infof("Enrolling the TPM2 for %s with PCRs %s\n", device.Device, configData.ZFS.Pool.Unlock.PCRs)
+				events.PromptRequired("systemd-cryptenroll will ask for the passphrase of " + device.Device + ".")
+			} else {
+				args = append(args, "--fido2-device=auto")
+				logger.Infof("Enrolling the FIDO2 token for %s\n", device.Device)
+				events.PromptRequired("systemd-cryptenroll will ask for the passphrase of " + device.Device + " and a touch of the FIDO2 token.")
+			}
+			args = append(args, device.Device)
+			utils.Execute(
+				execute,
+				"systemd-cryptenroll",
+				args...,
+			)
+		}
+		return
+	}
+
+	if !poolCreated {
+		logger.Warnf("The ZFS key of %s is only known when the pool is created, leaving the sealed key as is.\n", configData.ZFS.Pool.Name)
+		return
+	}
+
+	keyFile := zfsKeyFile(configData)
+	mountPointSealedKey := path.Join(configData.MountPoint, zfsSealedKeyPath(configData))
+	clevisConfig := fmt.Sprintf(`{"pcr_ids":"%s"}`, strings.ReplaceAll(configData.ZFS.Pool.Unlock.PCRs, "+", ","))
+
+	if !execute {
+		logger.Infof("DRY RUN: Would seal the ZFS key to the TPM2 with PCRs %s into %s\n", configData.ZFS.Pool.Unlock.PCRs, mountPointSealedKey)
+		return
+	}
+
+	// The key is passed on stdin so it is never logged.
+	// #nosec G304
+	key, err := os.ReadFile(keyFile)
+	validate.Panic(err)
+
+	logger.Infof("Sealing the ZFS key to the TPM2 with PCRs %s into %s\n", configData.ZFS.Pool.Unlock.PCRs, mountPointSealedKey)
+	sealed, err := utils.QueryInput(
+		string(key),
+		"clevis",
+		"encrypt",
+		"tpm2",
+		clevisConfig,
+	)
+	if err != nil {
+		validate.Panic(fmt.Errorf("unable to seal the ZFS key: %w", err))
+	}
+
+	err = os.MkdirAll(path.Dir(mountPointSealedKey), os.FileMode(0700))
+	validate.Panic(err)
+	err = os.WriteFile(mountPointSealedKey, []byte(sealed), os.FileMode(0600))
+	validate.Panic(err)
+
+	err = os.Remove(keyFile)
+	validate.Panic(err)
+
+	// The key is the only way in without the TPM2.
+	fmt.Println("")
+	fmt.Printf("IMPORTANT: The recovery key of the ZFS pool %s is below, store it somewhere safe.\n", configData.ZFS.Pool.Name)
+	fmt.Println("It unlocks the pool if the TPM2 can't, e.g. after a firmware update changes the PCRs.")
+	fmt.Println("")
+	fmt.Printf("  %s\n", string(key))
+	fmt.Println("")
+	logger.Info("Printed the recovery key of the ZFS pool to the console.")
+
+}
+
+// unlockSettings function will return the initrd settings to unlock the pool with the TPM2 or FIDO2 token.
+func unlockSettings(configData config.Config) []string {
+
+	settings := []string{}
+
+	if luksEnabled(configData) {
+		settings = append(settings, "boot.initrd.systemd.enable = true;")
+		for _, device := range luksDevices(configData) {
+			settings = append(settings, fmt.Sprintf(
+				"boot.initrd.luks.devices.\"%s\".crypttabExtraOpts = [ \"%s-device=auto\" ];",
+				device.Name,
+				configData.ZFS.Pool.Unlock.Method,
+			))
+		}
+		return settings
+	}
+
+	// clevis unseals the key and loads it into the encryption roots, otherwise it prompts.
+	settings = append(settings,
+		"boot.initrd.availableKernelModules = [ \"tpm_crb\" \"tpm_tis\" ];",
+		"boot.initrd.clevis.enable = true;",
+	)
+	for _, root := range encryptionRoots(configData, zfsDatasets(configData)) {
+		settings = append(settings, fmt.Sprintf("boot.initrd.clevis.devices.\"%s\".secretFile = \"%s\";", root, zfsSealedKeyPath(configData)))
+	}
+
+	return settings
+
+}
@@ -0,0 +1,414 @@
+// Package installer contains the logic for installing NixOS.
+// This file contains the logic for the ZFS pools.
+package installer
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	config "github.com/MAHDTech/nixos-installer/pkg/config"
+	events "github.com/MAHDTech/nixos-installer/pkg/events"
+	logger "github.com/MAHDTech/nixos-installer/pkg/logger"
+	utils "github.com/MAHDTech/nixos-installer/pkg/utils"
+)
+
+// partitionName function will return the name of a partition on a disk.
+func partitionName(disk string, partition int) string {
+	return fmt.Sprintf("%s-part%d", disk, partition)
+}
+
+// zfsPoolDevices function will return the devices used for the ZFS pool.
+func zfsPoolDevices(configData config.Config) []string {
+
+	// Without a boot pool the entire disk is used.
+	if !configData.ZFS.BootPool.Enabled {
+		return configData.ZFS.Disks
+	}
+
+	devices := []string{}
+	for _, zfsDisk := range configData.ZFS.Disks {
+		devices = append(devices, partitionName(zfsDisk, 2))
+	}
+
+	return devices
+
+}
+
+// bootPoolDevices function will return the devices used for the ZFS boot pool.
+func bootPoolDevices(configData config.Config) []string {
+
+	devices := []string{}
+	for _, zfsDisk := range configData.ZFS.Disks {
+		devices = append(devices, partitionName(zfsDisk, 1))
+	}
+
+	return devices
+
+}
+
+// zfsBootPoolName function will return the name of the pool holding /boot.
+func zfsBootPoolName(configData config.Config) string {
+	if configData.ZFS.BootPool.Enabled {
+		return configData.ZFS.BootPool.Name
+	}
+	return configData.ZFS.Pool.Name
+}
+
+// bootPoolArgs function will return the zpool arguments for the boot pool.
+func bootPoolArgs(configData config.Config, altRoot string) []string {
+
+	// GRUB can only read a limited set of pool features.
+	args := []string{"create", "-f"}
+	args = append(args, "-o", "compatibility=grub2")
+	args = append(args, "-o", "autotrim=on")
+	args = append(args, "-o", "ashift=12")
+
+	// Set the file system properties.
+	args = append(args, "-O", "acltype=posixacl")
+	args = append(args, "-O", "canmount=off")
+	args = append(args, "-O", "compression=lz4")
+	args = append(args, "-O", "devices=off")
+	args = append(args, "-O", "normalization=formD")
+	args = append(args, "-O", "relatime=on")
+	args = append(args, "-O", "xattr=sa")
+	args = append(args, "-O", "mountpoint=none")
+
+	// Set the temporary mount argument.
+	args = append(args, "-R", altRoot)
+
+	// Add the pool name.
+	args = append(args, configData.ZFS.BootPool.Name)
+
+	// Follow the layout of the main pool.
+	if len(configData.ZFS.Disks) > 1 && configData.ZFS.Pool.Mirror {
+		args = append(args, "mirror")
+	}
+
+	return append(args, bootPoolDevices(configData)...)
+
+}
+
+// zfsPoolImported function will return true if the pool is imported.
+func zfsPoolImported(pool string) bool {
+	_, err := utils.Query("zpool", "list", "-H", "-o", "name", pool)
+	return err == nil
+}
+
+// zfsPools function will return the pools of the configuration, the root pool first.
+func zfsPools(configData config.Config) []string {
+
+	pools := []string{configData.ZFS.Pool.Name}
+	if configData.ZFS.BootPool.Enabled {
+		pools = append(pools, configData.ZFS.BootPool.Name)
+	}
+
+	return pools
+
+}
+
+// importPools function will import the pools under the mountpoint without mounting them.
+// Pools that are already imported, e.g. on the installed system, are skipped.
+// It returns the pools that were imported.
+func importPools(execute bool, configData config.Config) []string {
+
+	importedPools := []string{}
+
+	for _, pool := range zfsPools(configData) {
+		if zfsPoolImported(pool) {
+			logger.Infof("ZFS pool %s is already imported.\n", pool)
+			continue
+		}
+
+		// The pool is only visible once its LUKS devices are open.
+		if luksEnabled(configData) && pool == configData.ZFS.Pool.Name {
+			openLUKS(execute, configData)
+		}
+
+		importArgs := []string{"import", "-N", "-R", configData.MountPoint}
+		logger.Infof("Importing ZFS pool %s.\n", pool)
+		// Load the encryption keys, prompting for the passphrase.
+		if (zfsNativeEncryption(configData) || config.DatasetEncryption(configData)) && pool == configData.ZFS.Pool.Name {
+			importArgs = append(importArgs, "-l")
+			events.PromptRequired("zpool import will ask for the encryption passphrase.")
+		}
+		utils.Execute(
+			execute,
+			"zpool",
+			append(importArgs, pool)...,
+		)
+		registerUndo("Export ZFS pool "+pool, "zpool", "export", pool)
+		importedPools = append(importedPools, pool)
+	}
+
+	return importedPools
+
+}
+
+// datasetPool function will return the pool holding the dataset.
+func datasetPool(dataset zfsDataset) string {
+	return strings.SplitN(dataset.Path, "/", 2)[0]
+}
+
+// existingDatasets function will return the datasets that exist in the pools of the layout.
+func existingDatasets(datasets []zfsDataset) map[string]bool {
+
+	existing := map[string]bool{}
+	pools := map[string]bool{}
+
+	for _, dataset := range datasets {
+		pool := datasetPool(dataset)
+		if pools[pool] {
+			continue
+		}
+		pools[pool] = true
+
+		output, err := utils.Query("zfs", "list", "-H", "-o", "name", "-t", "filesystem", "-r", pool)
+		if err != nil {
+			logger.Warnf("Unable to list the datasets in %s: %s\n", pool, err)
+			continue
+		}
+		for _, name := range strings.Fields(output) {
+			existing[name] = true
+		}
+	}
+
+	return existing
+
+}
+
+// zfsFilesystem is the ZFS pool with a dataset for each entry in the layout.
+type zfsFilesystem struct {
+	// bootEnv adds a boot environment to the existing pool instead of creating it.
+	bootEnv bool
+
+	// existing are the datasets kept from the existing pool.
+	existing map[string]bool
+
+	// datasets are the datasets of the layout, including the containers.
+	datasets []zfsDataset
+}
+
+// layout function will return the volumes of the ZFS datasets.
+func (fs *zfsFilesystem) layout() []volume {
+	volumes := []volume{}
+	for _, dataset := range fs.datasets {
+		volumes = append(volumes, dataset.volume)
+	}
+	return volumes
+}
+
+// create function will wipe the disks and create the pools, or import them for a boot environment.
+func (fs *zfsFilesystem) create(execute bool, configData config.Config, mountpointsJSON []byte) {
+	if fs.bootEnv {
+		fs.existing = prepareBootEnvironment(execute, configData, fs.datasets)
+		return
+	}
+	createPools(execute, configData, mountpointsJSON)
+}
+
+// createVolumes function will create the datasets and the swap volume.
+func (fs *zfsFilesystem) createVolumes(execute bool, configData config.Config) {
+
+	zfsPoolName := configData.ZFS.Pool.Name
+	logger.Info("Creating ZFS datasets.")
+
+	// The sealed key only exists when the pool was created by this run.
+	zfsKeySealedNew := zfsKeySealed(configData) && !fs.bootEnv
+	zfsEncryptionArgsDataset := zfsEncryptionArgs(configData, "-o", zfsKeySealedNew)
+
+	// Create the datasets in the layout.
+	for _, dataset := range datasetCreateOrder(fs.datasets) {
+		if fs.existing[dataset.Path] {
+			continue
+		}
+		if dataset.mounted() {
+			logger.Infof("Creating dataset %s for %s\n", dataset.Path, dataset.Mountpoint)
+		} else {
+			logger.Infof("Creating container dataset %s\n", dataset.Path)
+		}
+		if dataset.EncryptionRoot && !zfsKeySealedNew {
+			events.PromptRequired("zfs create will ask for the new encryption passphrase of " + dataset.Path + ".")
+		}
+		utils.Execute(
+			execute,
+			"zfs",
+			dataset.createArgs(zfsEncryptionArgsDataset)...,
+		)
+		registerUndo("Destroy dataset "+dataset.Path, "zfs", "destroy", "-r", dataset.Path)
+		if dataset.EncryptionRoot && zfsKeySealedNew {
+			promptKeyLocation(execute, dataset.Path)
+		}
+
+		// Snapshot the root dataset while it is still empty.
+		if configData.ZFS.Impermanence.Enabled && dataset.Mountpoint == "/" {
+			snapshotBlank := dataset.Path + "@" + zfsSnapshotBlank
+			logger.Infof("Creating blank snapshot: %s\n", snapshotBlank)
+			utils.Execute(
+				execute,
+				"zfs",
+				"snapshot",
+				snapshotBlank,
+			)
+		}
+	}
+
+	// Create the swap dataset if it is enabled.
+	if fs.bootEnv {
+		logger.Info("Skipping swap dataset creation as the boot environment shares the pool.")
+	} else if configData.Swap.Enabled {
+		zfsDataSetPathSwap := path.Join(zfsPoolName, zfsDatasetSwap)
+		logger.Infof("Creating swap dataset: %s\n", zfsDataSetPathSwap)
+		swapArgs := []string{"create", "-V", configData.Swap.Size}
+		if swapEncrypted(configData) {
+			if !zfsKeySealedNew {
+				events.PromptRequired("zfs create will ask for the new encryption passphrase of " + zfsDataSetPathSwap + ".")
+			}
+			swapArgs = append(swapArgs, zfsEncryptionArgsDataset...)
+		}
+		utils.Execute(
+			execute,
+			"zfs",
+			append(swapArgs, zfsDataSetPathSwap)...,
+		)
+		registerUndo("Destroy swap dataset "+zfsDataSetPathSwap, "zfs", "destroy", zfsDataSetPathSwap)
+		if swapEncrypted(configData) && zfsKeySealedNew {
+			promptKeyLocation(execute, zfsDataSetPathSwap)
+		}
+	} else {
+		logger.Info("Skipping swap dataset creation as it is disabled.")
+	}
+
+}
+
+// open function will import the pools and unlock the encryption.
+func (fs *zfsFilesystem) open(execute bool, configData config.Config) {
+	importPools(execute, configData)
+}
+
+// mount function will mount the datasets with parents before children.
+func (fs *zfsFilesystem) mount(execute bool, configData config.Config) {
+
+	for _, dataset := range volumeMountOrder(fs.layout()) {
+		if !dataset.mounted() {
+			continue
+		}
+		mountPointDataset := path.Join(configData.MountPoint, dataset.Mountpoint)
+		logger.Infof("Mounting %s to %s.\n", dataset.Path, mountPointDataset)
+		utils.Execute(
+			execute,
+			"mount",
+			"-o",
+			"X-mount.mkdir",
+			"-t",
+			"zfs",
+			dataset.Path,
+			mountPointDataset,
+		)
+		registerUndo("Unmount "+mountPointDataset, "umount", mountPointDataset)
+	}
+
+}
+
+// settings function will return the settings to unlock and roll back the datasets.
+func (fs *zfsFilesystem) settings(configData config.Config) []string {
+
+	settings := []string{}
+
+	if luksEnabled(configData) {
+		settings = append(settings, luksSettings(configData)...)
+	}
+
+	if config.DatasetEncryption(configData) {
+		settings = append(settings, encryptionSettings(configData, fs.datasets)...)
+	}
+
+	if unlockEnrolled(configData) {
+		settings = append(settings, unlockSettings(configData)...)
+	}
+
+	if configData.ZFS.Impermanence.Enabled {
+		settings = append(settings, impermanenceSettings(configData, fs.datasets)...)
+	}
+
+	return settings
+
+}
+
+// snapshot function will snapshot the freshly installed system as a baseline.
+func (fs *zfsFilesystem) snapshot(execute bool, configData config.Config) {
+
+	zfsSnapshotInstall := "install-" + time.Now().UTC().Format("20060102-150405")
+	for _, dataset := range datasetCreateOrder(fs.datasets) {
+		if !dataset.mounted() {
+			continue
+		}
+		// Rolling back to the blank snapshot would destroy it on first boot.
+		if configData.ZFS.Impermanence.Enabled && dataset.Mountpoint == "/" {
+			continue
+		}
+		snapshotInstall := dataset.Path + "@" + zfsSnapshotInstall
+		logger.Infof("Creating install snapshot: %s\n", snapshotInstall)
+		utils.Execute(
+			execute,
+			"zfs",
+			"snapshot",
+			snapshotInstall,
+		)
+	}
+
+}
+
+// release function will turn off swap and export the pools so they import cleanly on the next boot.
+// It returns false if a pool could not be exported.
+func (fs *zfsFilesystem) release(execute bool, configData config.Config) bool {
+
+	clean := true
+
+	// Turn off the swap volume if it is enabled.
+	if configData.Swap.Enabled {
+		zfsDataSetPathSwap := path.Join("/dev/zvol", configData.ZFS.Pool.Name, zfsDatasetSwap)
+		logger.Infof("Turning off swap on %s.\n", zfsDataSetPathSwap)
+		utils.ExecuteSilent(
+			execute,
+			"swapoff",
+			zfsDataSetPathSwap,
+		)
+	}
+
+	// Export the pools so they import cleanly on the next boot.
+	pools := []string{configData.ZFS.Pool.Name}
+	if configData.ZFS.BootPool.Enabled {
+		pools = append([]string{configData.ZFS.BootPool.Name}, pools...)
+	}
+	for _, pool := range pools {
+		// The running system may be using the pool, e.g. after adding a boot environment.
+		if zfsPoolInUse(pool, configData.MountPoint) {
+			logger.Warnf("Skipping export of ZFS pool %s as it is in use outside of %s.\n", pool, configData.MountPoint)
+			continue
+		}
+		logger.Infof("Exporting ZFS pool %s.\n", pool)
+		err := utils.ExecuteSilent(
+			execute,
+			"zpool",
+			"export",
+			pool,
+		)
+		if err != nil {
+			clean = false
+			logger.Warnf("ZFS pool %s may need 'zpool import -f' on the next boot.\n", pool)
+			continue
+		}
+
+		// Close the LUKS devices under the exported pool.
+		if luksEnabled(configData) && pool == configData.ZFS.Pool.Name {
+			if !closeLUKS(execute, configData) {
+				clean = false
+			}
+		}
+	}
+
+	return clean
+
+}
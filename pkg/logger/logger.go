@@ -0,0 +1,261 @@
+// Package logger provides levelled logging and the install transcript for the installer.
+package logger
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	events "github.com/MAHDTech/nixos-installer/pkg/events"
+)
+
+// Level is the severity of a log message.
+type Level int
+
+// The supported log levels.
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// The supported log formats.
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// String function will return the name of the level.
+func (level Level) String() string {
+	switch level {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	default:
+		return "ERROR"
+	}
+}
+
+// ParseLevel function will return the level for a name such as info.
+func ParseLevel(name string) (Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return LevelDebug, nil
+	case "info", "":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return LevelInfo, errors.New("invalid log level: " + name)
+}
+
+// Command is the record of a command that was run, or would have been run.
+type Command struct {
+	Argv       []string `json:"argv"`
+	DryRun     bool     `json:"dryRun"`
+	ExitCode   int      `json:"exitCode"`
+	DurationMS int64    `json:"durationMs"`
+	Stderr     string   `json:"stderr,omitempty"`
+}
+
+// entry is a line in the JSON output and the transcript.
+type entry struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Message string    `json:"msg"`
+	Command *Command  `json:"command,omitempty"`
+}
+
+// Logger writes messages to the console and every message and command to the transcript.
+type Logger struct {
+	mu             sync.Mutex
+	level          Level
+	format         string
+	out            io.Writer
+	transcript     *os.File
+	transcriptPath string
+}
+
+// The logger used by the package level functions.
+var std = &Logger{level: LevelInfo, format: FormatText, out: os.Stderr}
+
+// Configure function will set the level and format of the console output.
+func Configure(level string, format string) error {
+
+	parsedLevel, err := ParseLevel(level)
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case "":
+		format = FormatText
+	case FormatText, FormatJSON:
+	default:
+		return errors.New("invalid log format: " + format)
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+	std.level = parsedLevel
+	std.format = format
+
+	return nil
+
+}
+
+// OpenTranscript function will start writing the transcript to the file.
+func OpenTranscript(path string) error {
+
+	// #nosec G304
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+	std.transcript = file
+	std.transcriptPath = path
+
+	return nil
+
+}
+
+// TranscriptPath function will return the path of the transcript, if any.
+func TranscriptPath() string {
+	std.mu.Lock()
+	defer std.mu.Unlock()
+	return std.transcriptPath
+}
+
+// Close function will close the transcript.
+func Close() {
+	std.mu.Lock()
+	defer std.mu.Unlock()
+	if std.transcript != nil {
+		_ = std.transcript.Close()
+		std.transcript = nil
+	}
+}
+
+// write function will write the entry to the console and the transcript.
+func (logger *Logger) write(level Level, message string, command *Command) {
+
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+
+	line := entry{
+		Time:    time.Now(),
+		Level:   level.String(),
+		Message: strings.TrimRight(message, "\n"),
+		Command: command,
+	}
+	lineJSON, err := json.Marshal(line)
+	if err != nil {
+		lineJSON = []byte(fmt.Sprintf(`{"level":"ERROR","msg":%q}`, err.Error()))
+	}
+
+	// Errors are also reported to anything following the progress events.
+	if level == LevelError {
+		events.Error(line.Message)
+	}
+
+	// The transcript keeps everything, regardless of the level.
+	if logger.transcript != nil {
+		_, _ = logger.transcript.Write(append(lineJSON, '\n'))
+	}
+
+	if level < logger.level {
+		return
+	}
+
+	if logger.format == FormatJSON {
+		_, _ = logger.out.Write(append(lineJSON, '\n'))
+		return
+	}
+
+	_, _ = fmt.Fprintf(
+		logger.out,
+		"%s %-5s %s\n",
+		line.Time.Format("2006/01/02 15:04:05"),
+		line.Level,
+		line.Message,
+	)
+
+}
+
+// Debugf function will log a debug message.
+func Debugf(format string, args ...any) {
+	std.write(LevelDebug, fmt.Sprintf(format, args...), nil)
+}
+
+// Info function will log an informational message.
+func Info(message string) {
+	std.write(LevelInfo, message, nil)
+}
+
+// Infof function will log an informational message.
+func Infof(format string, args ...any) {
+	std.write(LevelInfo, fmt.Sprintf(format, args...), nil)
+}
+
+// Warn function will log a warning.
+func Warn(message string) {
+	std.write(LevelWarn, message, nil)
+}
+
+// Warnf function will log a warning.
+func Warnf(format string, args ...any) {
+	std.write(LevelWarn, fmt.Sprintf(format, args...), nil)
+}
+
+// Errorf function will log an error.
+func Errorf(format string, args ...any) {
+	std.write(LevelError, fmt.Sprintf(format, args...), nil)
+}
+
+// Fatal function will log an error, close the transcript and exit.
+func Fatal(args ...any) {
+	std.write(LevelError, fmt.Sprint(args...), nil)
+	Close()
+	os.Exit(1)
+}
+
+// Fatalf function will log an error, close the transcript and exit.
+func Fatalf(format string, args ...any) {
+	Fatal(fmt.Sprintf(format, args...))
+}
+
+// Panic function will log an error and panic.
+func Panic(args ...any) {
+	message := fmt.Sprint(args...)
+	std.write(LevelError, message, nil)
+	panic(message)
+}
+
+// Panicf function will log an error and panic.
+func Panicf(format string, args ...any) {
+	Panic(fmt.Sprintf(format, args...))
+}
+
+// LogCommand function will record a command in the transcript.
+// Commands are only shown on the console at the debug level.
+func LogCommand(command Command) {
+	message := fmt.Sprintf("Ran %s (exit code %d, %dms)", strings.Join(command.Argv, " "), command.ExitCode, command.DurationMS)
+	if command.DryRun {
+		message = "Dry run of " + strings.Join(command.Argv, " ")
+	}
+	std.write(LevelDebug, message, &command)
+}
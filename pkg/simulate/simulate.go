@@ -0,0 +1,599 @@
+// Package simulate provides an in-memory model of the disks, pools, datasets and mounts.
+// During a dry run every command is applied to the model instead of the system,
+// so the installer can predict which commands would fail rather than only echo them.
+package simulate
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// disk is a block device and its partitions.
+type disk struct {
+	// Partitions maps the partition number to its file system, "" when unformatted.
+	Partitions map[int]string
+}
+
+// pool is a ZFS pool.
+type pool struct {
+	Imported bool
+
+	// Unknown is true when the datasets in the pool are not known, e.g. a pool imported during the dry run.
+	Unknown bool
+}
+
+// system is the simulated state.
+type system struct {
+	Disks     map[string]*disk
+	Pools     map[string]*pool
+	Datasets  map[string]bool
+	Snapshots map[string]bool
+	Mounts    map[string]string
+}
+
+// The simulated state, nil when the simulation is not running.
+var state *system
+
+// The partition naming used by the installer, e.g. /dev/disk/by-id/nvme-x-part2.
+var regexPartition = regexp.MustCompile(`^(.+)-part(\d+)$`)
+
+// Start function will start an empty simulation.
+func Start() {
+	state = &system{
+		Disks:     map[string]*disk{},
+		Pools:     map[string]*pool{},
+		Datasets:  map[string]bool{},
+		Snapshots: map[string]bool{},
+		Mounts:    map[string]string{},
+	}
+}
+
+// Enabled function will return true if the simulation is running.
+func Enabled() bool {
+	return state != nil
+}
+
+// AddDisk function will add an existing disk and its partitions to the simulation.
+func AddDisk(device string, partitions []int) {
+	if state == nil {
+		return
+	}
+	simulated := &disk{Partitions: map[int]string{}}
+	for _, partition := range partitions {
+		// The file system of an existing partition is unknown.
+		simulated.Partitions[partition] = "?"
+	}
+	state.Disks[device] = simulated
+}
+
+// AddPool function will add an existing pool to the simulation.
+func AddPool(name string, imported bool) {
+	if state == nil {
+		return
+	}
+	state.Pools[name] = &pool{Imported: imported}
+	state.Datasets[name] = true
+}
+
+// AddDataset function will add an existing dataset to the simulation.
+func AddDataset(name string) {
+	if state == nil {
+		return
+	}
+	state.Datasets[name] = true
+}
+
+// AddMount function will add an existing mount to the simulation.
+func AddMount(source string, target string) {
+	if state == nil {
+		return
+	}
+	state.Mounts[target] = source
+}
+
+// Apply function will apply a command to the simulation.
+// It returns an error describing why the command would fail on the real system.
+// Commands that are not modelled are assumed to succeed.
+func Apply(argv []string) error {
+
+	if state == nil || len(argv) == 0 {
+		return nil
+	}
+
+	args := argv[1:]
+	switch path.Base(argv[0]) {
+	case "sgdisk":
+		return state.sgdisk(args)
+	case "parted":
+		return state.parted(args)
+	case "mkfs.vfat":
+		return state.mkfs("vfat", args)
+	case "mkfs.xfs":
+		return state.mkfs("xfs", args)
+	case "mkfs.ext4":
+		return state.mkfs("ext4", args)
+	case "mkfs.btrfs":
+		return state.mkfs("btrfs", args)
+	case "cryptsetup":
+		return state.cryptsetup(args)
+	case "zpool":
+		return state.zpool(args)
+	case "zfs":
+		return state.zfs(args)
+	case "mount":
+		return state.mount(args)
+	case "umount":
+		return state.umount(args)
+	}
+
+	return nil
+
+}
+
+// Summary function will return the predicted state of the system.
+// Only the mounts under the root are included.
+func Summary(root string) []string {
+
+	if state == nil {
+		return nil
+	}
+
+	lines := []string{}
+
+	for _, device := range sortedKeys(state.Disks) {
+		numbers := []int{}
+		for number := range state.Disks[device].Partitions {
+			numbers = append(numbers, number)
+		}
+		sort.Ints(numbers)
+		partitions := []string{}
+		for _, number := range numbers {
+			partitions = append(partitions, fmt.Sprintf("part%d (%s)", number, state.Disks[device].Partitions[number]))
+		}
+		if len(partitions) == 0 {
+			partitions = append(partitions, "no partitions")
+		}
+		lines = append(lines, fmt.Sprintf("disk %s: %s", device, strings.Join(partitions, ", ")))
+	}
+
+	for _, name := range sortedKeys(state.Pools) {
+		status := "exported"
+		if state.Pools[name].Imported {
+			status = "imported"
+		}
+		lines = append(lines, fmt.Sprintf("pool %s: %s", name, status))
+	}
+
+	for _, name := range sortedKeys(state.Datasets) {
+		if _, isPool := state.Pools[name]; isPool {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("dataset %s", name))
+	}
+
+	for _, name := range sortedKeys(state.Snapshots) {
+		lines = append(lines, fmt.Sprintf("snapshot %s", name))
+	}
+
+	for _, target := range sortedKeys(state.Mounts) {
+		if target != root && !strings.HasPrefix(target, root+"/") {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("mount %s on %s", state.Mounts[target], target))
+	}
+
+	return lines
+
+}
+
+// sortedKeys function will return the keys of a map in order.
+func sortedKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// positional function will return the arguments that are not flags.
+// Flags listed in withValue consume the following argument.
+func positional(args []string, withValue ...string) []string {
+
+	values := []string{}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if strings.HasPrefix(arg, "-") {
+			for _, flag := range withValue {
+				if arg == flag {
+					i++
+					break
+				}
+			}
+			continue
+		}
+		values = append(values, arg)
+	}
+
+	return values
+
+}
+
+// partition function will check that a partition exists.
+// Devices that are not part of the simulation are assumed to exist.
+func (s *system) partition(device string) (*disk, int, error) {
+
+	match := regexPartition.FindStringSubmatch(device)
+	if match == nil {
+		return nil, 0, nil
+	}
+
+	simulated, ok := s.Disks[match[1]]
+	if !ok {
+		return nil, 0, nil
+	}
+
+	number, _ := strconv.Atoi(match[2])
+	if _, ok := simulated.Partitions[number]; !ok {
+		return nil, 0, fmt.Errorf("%s would not exist, %s has %s", device, match[1], describePartitions(simulated))
+	}
+
+	return simulated, number, nil
+
+}
+
+// describePartitions function will describe the partitions on a disk for an error.
+func describePartitions(simulated *disk) string {
+	if len(simulated.Partitions) == 0 {
+		return "no partitions"
+	}
+	if len(simulated.Partitions) == 1 {
+		return "1 partition"
+	}
+	return fmt.Sprintf("%d partitions", len(simulated.Partitions))
+}
+
+// nextPartition function will return the number parted gives a new partition.
+// The number follows the highest existing one, so gaps are not filled.
+func nextPartition(simulated *disk) int {
+	highest := 0
+	for number := range simulated.Partitions {
+		highest = max(highest, number)
+	}
+	return highest + 1
+}
+
+// sgdisk function will wipe the partition table.
+func (s *system) sgdisk(args []string) error {
+	for _, device := range positional(args) {
+		if simulated, ok := s.Disks[device]; ok {
+			simulated.Partitions = map[int]string{}
+		}
+	}
+	return nil
+}
+
+// parted function will apply the partition table changes after the '--'.
+func (s *system) parted(args []string) error {
+
+	device := ""
+	commands := []string{}
+	for i, arg := range args {
+		if arg == "--" {
+			commands = args[i+1:]
+			break
+		}
+	}
+	devices := positional(args[:len(args)-len(commands)], "--align")
+	if len(devices) > 0 {
+		device = devices[len(devices)-1]
+	}
+
+	simulated, ok := s.Disks[device]
+	if !ok {
+		return nil
+	}
+
+	for i, command := range commands {
+		switch command {
+		case "mklabel":
+			simulated.Partitions = map[int]string{}
+		case "mkpart":
+			simulated.Partitions[nextPartition(simulated)] = ""
+		case "set":
+			if i+1 >= len(commands) {
+				continue
+			}
+			number, err := strconv.Atoi(commands[i+1])
+			if err != nil {
+				continue
+			}
+			if _, ok := simulated.Partitions[number]; !ok {
+				return fmt.Errorf("partition %d on %s would not exist, it has %s", number, device, describePartitions(simulated))
+			}
+		}
+	}
+
+	return nil
+
+}
+
+// mkfs function will format the partitions, btrfs can span several.
+func (s *system) mkfs(fsType string, args []string) error {
+
+	for _, device := range positional(args, "-n", "-L", "-d", "-m") {
+		simulated, number, err := s.partition(device)
+		if err != nil {
+			return err
+		}
+		if simulated != nil {
+			simulated.Partitions[number] = fsType
+		}
+	}
+
+	return nil
+
+}
+
+// cryptsetup function will check the LUKS device exists.
+func (s *system) cryptsetup(args []string) error {
+
+	if len(args) == 0 {
+		return nil
+	}
+
+	values := positional(args[1:], "--type")
+	switch args[0] {
+	case "luksFormat", "open":
+		if len(values) == 0 {
+			return nil
+		}
+		simulated, number, err := s.partition(values[0])
+		if err != nil {
+			return err
+		}
+		if simulated != nil && args[0] == "luksFormat" {
+			simulated.Partitions[number] = "luks"
+		}
+	}
+
+	return nil
+
+}
+
+// zpool function will apply the pool changes.
+func (s *system) zpool(args []string) error {
+
+	if len(args) == 0 {
+		return nil
+	}
+
+	values := positional(args[1:], "-o", "-O", "-R", "-d")
+	switch args[0] {
+	case "create":
+		if len(values) == 0 {
+			return nil
+		}
+		name := values[0]
+		if _, ok := s.Pools[name]; ok {
+			return fmt.Errorf("pool %s would already exist", name)
+		}
+		for _, device := range values[1:] {
+			if _, _, err := s.partition(device); err != nil {
+				return err
+			}
+		}
+		s.Pools[name] = &pool{Imported: true}
+		s.Datasets[name] = true
+	case "destroy":
+		if len(values) == 0 {
+			return nil
+		}
+		if _, ok := s.Pools[values[0]]; !ok {
+			return fmt.Errorf("pool %s would not exist", values[0])
+		}
+		s.removeDatasets(values[0])
+		delete(s.Pools, values[0])
+	case "export":
+		if len(values) == 0 {
+			return nil
+		}
+		simulated, ok := s.Pools[values[0]]
+		if !ok || !simulated.Imported {
+			return fmt.Errorf("pool %s would not be imported", values[0])
+		}
+		s.unmountDatasets(values[0])
+		simulated.Imported = false
+	case "import":
+		if len(values) == 0 {
+			return nil
+		}
+		simulated, ok := s.Pools[values[len(values)-1]]
+		if !ok {
+			// An exported pool on the disks is not known until it is imported.
+			s.Pools[values[len(values)-1]] = &pool{Imported: true, Unknown: true}
+			s.Datasets[values[len(values)-1]] = true
+			return nil
+		}
+		if simulated.Imported {
+			return fmt.Errorf("pool %s would already be imported", values[len(values)-1])
+		}
+		simulated.Imported = true
+	}
+
+	return nil
+
+}
+
+// zfs function will apply the dataset changes.
+func (s *system) zfs(args []string) error {
+
+	if len(args) == 0 {
+		return nil
+	}
+
+	values := positional(args[1:], "-o", "-V")
+	if len(values) == 0 {
+		return nil
+	}
+	name := values[len(values)-1]
+
+	switch args[0] {
+	case "create":
+		if s.Datasets[name] {
+			return fmt.Errorf("dataset %s would already exist", name)
+		}
+		if err := s.imported(name); err != nil {
+			return err
+		}
+		parent := path.Dir(name)
+		if parent != "." && !s.exists(parent) && !slices.Contains(args, "-p") {
+			return fmt.Errorf("parent dataset %s would not exist", parent)
+		}
+		s.Datasets[name] = true
+	case "destroy":
+		if !s.exists(name) {
+			return fmt.Errorf("dataset %s would not exist", name)
+		}
+		if !slices.Contains(args, "-r") && s.hasChildren(name) {
+			return fmt.Errorf("dataset %s would have children", name)
+		}
+		s.removeDatasets(name)
+	case "snapshot":
+		dataset, _, _ := strings.Cut(name, "@")
+		if !s.exists(dataset) {
+			return fmt.Errorf("dataset %s would not exist", dataset)
+		}
+		s.Snapshots[name] = true
+	case "set":
+		if !s.exists(name) {
+			return fmt.Errorf("dataset %s would not exist", name)
+		}
+	}
+
+	return nil
+
+}
+
+// mount function will mount a dataset or partition.
+func (s *system) mount(args []string) error {
+
+	fsType := ""
+	for i, arg := range args {
+		if arg == "-t" && i+1 < len(args) {
+			fsType = args[i+1]
+		}
+	}
+
+	values := positional(args, "-o", "-t")
+	if len(values) != 2 {
+		return nil
+	}
+	source, target := values[0], values[1]
+
+	if current, ok := s.Mounts[target]; ok {
+		return fmt.Errorf("%s would already have %s mounted", target, current)
+	}
+
+	if fsType == "zfs" {
+		if !s.exists(source) {
+			return fmt.Errorf("dataset %s would not exist", source)
+		}
+		if err := s.imported(source); err != nil {
+			return err
+		}
+	} else {
+		simulated, number, err := s.partition(source)
+		if err != nil {
+			return err
+		}
+		if simulated != nil {
+			formatted := simulated.Partitions[number]
+			if formatted == "" {
+				return fmt.Errorf("%s would not be formatted", source)
+			}
+			if fsType != "" && formatted != "?" && formatted != fsType {
+				return fmt.Errorf("%s would be formatted as %s, not %s", source, formatted, fsType)
+			}
+		}
+	}
+
+	s.Mounts[target] = source
+
+	return nil
+
+}
+
+// umount function will unmount a mountpoint.
+func (s *system) umount(args []string) error {
+	for _, target := range positional(args) {
+		if _, ok := s.Mounts[target]; !ok {
+			return fmt.Errorf("%s would not be mounted", target)
+		}
+		delete(s.Mounts, target)
+	}
+	return nil
+}
+
+// imported function will check the pool of a dataset is imported.
+func (s *system) imported(name string) error {
+	poolName, _, _ := strings.Cut(name, "/")
+	simulated, ok := s.Pools[poolName]
+	if !ok {
+		return fmt.Errorf("pool %s would not exist", poolName)
+	}
+	if !simulated.Imported {
+		return fmt.Errorf("pool %s would not be imported", poolName)
+	}
+	return nil
+}
+
+// exists function will return true if the dataset exists.
+// Datasets in a pool with unknown contents are assumed to exist.
+func (s *system) exists(name string) bool {
+	if s.Datasets[name] {
+		return true
+	}
+	poolName, _, _ := strings.Cut(name, "/")
+	simulated, ok := s.Pools[poolName]
+	return ok && simulated.Unknown
+}
+
+// hasChildren function will return true if the dataset has child datasets.
+func (s *system) hasChildren(name string) bool {
+	for dataset := range s.Datasets {
+		if strings.HasPrefix(dataset, name+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// removeDatasets function will remove a dataset, its children and their snapshots and mounts.
+func (s *system) removeDatasets(name string) {
+	s.unmountDatasets(name)
+	for dataset := range s.Datasets {
+		if dataset == name || strings.HasPrefix(dataset, name+"/") {
+			delete(s.Datasets, dataset)
+		}
+	}
+	for snapshot := range s.Snapshots {
+		if strings.HasPrefix(snapshot, name+"@") || strings.HasPrefix(snapshot, name+"/") {
+			delete(s.Snapshots, snapshot)
+		}
+	}
+}
+
+// unmountDatasets function will unmount a dataset and its children.
+func (s *system) unmountDatasets(name string) {
+	for target, source := range s.Mounts {
+		if source == name || strings.HasPrefix(source, name+"/") {
+			delete(s.Mounts, target)
+		}
+	}
+}
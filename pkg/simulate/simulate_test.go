@@ -0,0 +1,304 @@
+package simulate
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+// testSetup describes the existing state of a test case.
+type testSetup struct {
+	disks    map[string][]int
+	pools    map[string]bool
+	datasets []string
+	mounts   map[string]string
+}
+
+// start function will start a simulation with the existing state.
+func (setup testSetup) start() {
+	Start()
+	for device, partitions := range setup.disks {
+		AddDisk(device, partitions)
+	}
+	for name, imported := range setup.pools {
+		AddPool(name, imported)
+	}
+	for _, name := range setup.datasets {
+		AddDataset(name)
+	}
+	for target, source := range setup.mounts {
+		AddMount(source, target)
+	}
+}
+
+func TestApply(t *testing.T) {
+
+	parted := []string{"parted", "--script", "--fix", "--align", "optimal", "/dev/sda", "--"}
+
+	tests := []struct {
+		name     string
+		setup    testSetup
+		commands [][]string
+		// wantErr is part of the error of the last command, the others must succeed.
+		wantErr string
+		want    []string
+	}{
+		{
+			name:     "sgdisk wipes the partitions",
+			setup:    testSetup{disks: map[string][]int{"/dev/sda": {1, 2}}},
+			commands: [][]string{{"sgdisk", "--zap-all", "/dev/sda"}},
+			want:     []string{"disk /dev/sda: no partitions"},
+		},
+		{
+			name:     "sgdisk ignores unknown disks",
+			setup:    testSetup{disks: map[string][]int{"/dev/sda": {1}}},
+			commands: [][]string{{"sgdisk", "--zap-all", "/dev/sdb"}},
+			want:     []string{"disk /dev/sda: part1 (?)"},
+		},
+		{
+			name:  "parted creates a new table",
+			setup: testSetup{disks: map[string][]int{"/dev/sda": {1, 2, 3}}},
+			commands: [][]string{
+				append(slices.Clone(parted), "mklabel", "gpt", "mkpart", "ESP", "fat32", "1MiB", "4GiB", "mkpart", "nixos", "4GiB", "100%"),
+			},
+			want: []string{"disk /dev/sda: part1 (), part2 ()"},
+		},
+		{
+			name:  "parted numbers after the highest partition",
+			setup: testSetup{disks: map[string][]int{"/dev/sda": {1, 3}}},
+			commands: [][]string{
+				append(slices.Clone(parted), "mkpart", "nixos", "4GiB", "100%"),
+			},
+			want: []string{"disk /dev/sda: part1 (?), part3 (?), part4 ()"},
+		},
+		{
+			name:  "parted sets a flag",
+			setup: testSetup{disks: map[string][]int{"/dev/sda": {}}},
+			commands: [][]string{
+				append(slices.Clone(parted), "mklabel", "gpt", "mkpart", "ESP", "fat32", "1MiB", "4GiB"),
+				append(slices.Clone(parted), "set", "1", "esp", "on"),
+			},
+			want: []string{"disk /dev/sda: part1 ()"},
+		},
+		{
+			name:  "parted sets a flag on a missing partition",
+			setup: testSetup{disks: map[string][]int{"/dev/sda": {1}}},
+			commands: [][]string{
+				append(slices.Clone(parted), "set", "2", "esp", "on"),
+			},
+			wantErr: "partition 2 on /dev/sda would not exist, it has 1 partition",
+		},
+		{
+			name:  "mkfs formats a partition",
+			setup: testSetup{disks: map[string][]int{"/dev/sda": {}}},
+			commands: [][]string{
+				append(slices.Clone(parted), "mklabel", "gpt", "mkpart", "ESP", "fat32", "1MiB", "4GiB"),
+				{"mkfs.vfat", "-n", "EFI", "/dev/sda-part1"},
+			},
+			want: []string{"disk /dev/sda: part1 (vfat)"},
+		},
+		{
+			name:     "mkfs on a missing partition",
+			setup:    testSetup{disks: map[string][]int{"/dev/sda": {}}},
+			commands: [][]string{{"mkfs.xfs", "-L", "nixos", "/dev/sda-part2"}},
+			wantErr:  "/dev/sda-part2 would not exist, /dev/sda has no partitions",
+		},
+		{
+			name:  "zpool create",
+			setup: testSetup{disks: map[string][]int{"/dev/sda": {1}}},
+			commands: [][]string{
+				{"zpool", "create", "-f", "-O", "compression=zstd", "-R", "/mnt", "zpool", "/dev/sda-part1"},
+			},
+			want: []string{"disk /dev/sda: part1 (?)", "pool zpool: imported"},
+		},
+		{
+			name:     "zpool create on a missing partition",
+			setup:    testSetup{disks: map[string][]int{"/dev/sda": {1}}},
+			commands: [][]string{{"zpool", "create", "zpool", "/dev/sda-part2"}},
+			wantErr:  "/dev/sda-part2 would not exist",
+		},
+		{
+			name:     "zpool create an existing pool",
+			setup:    testSetup{pools: map[string]bool{"zpool": false}},
+			commands: [][]string{{"zpool", "create", "zpool", "/dev/sdb"}},
+			wantErr:  "pool zpool would already exist",
+		},
+		{
+			name:     "zpool import an exported pool",
+			setup:    testSetup{pools: map[string]bool{"zpool": false}},
+			commands: [][]string{{"zpool", "import", "-N", "-R", "/mnt", "zpool"}},
+			want:     []string{"pool zpool: imported"},
+		},
+		{
+			name:  "zpool import an unknown pool",
+			setup: testSetup{},
+			commands: [][]string{
+				{"zpool", "import", "-N", "zpool"},
+				{"zfs", "set", "mountpoint=legacy", "zpool/home"},
+			},
+			want: []string{"pool zpool: imported"},
+		},
+		{
+			name:     "zpool import an imported pool",
+			setup:    testSetup{pools: map[string]bool{"zpool": true}},
+			commands: [][]string{{"zpool", "import", "-N", "zpool"}},
+			wantErr:  "pool zpool would already be imported",
+		},
+		{
+			name: "zpool export unmounts the datasets",
+			setup: testSetup{
+				pools:    map[string]bool{"zpool": true},
+				datasets: []string{"zpool/root"},
+				mounts:   map[string]string{"/mnt": "zpool/root"},
+			},
+			commands: [][]string{{"zpool", "export", "zpool"}},
+			want:     []string{"pool zpool: exported", "dataset zpool/root"},
+		},
+		{
+			name:     "zpool export an exported pool",
+			setup:    testSetup{pools: map[string]bool{"zpool": false}},
+			commands: [][]string{{"zpool", "export", "zpool"}},
+			wantErr:  "pool zpool would not be imported",
+		},
+		{
+			name:  "zfs create",
+			setup: testSetup{pools: map[string]bool{"zpool": true}},
+			commands: [][]string{
+				{"zfs", "create", "-o", "canmount=off", "-o", "mountpoint=none", "zpool/ROOT"},
+				{"zfs", "create", "-o", "mountpoint=legacy", "zpool/ROOT/nixos"},
+			},
+			want: []string{"pool zpool: imported", "dataset zpool/ROOT", "dataset zpool/ROOT/nixos"},
+		},
+		{
+			name:     "zfs create without the parent",
+			setup:    testSetup{pools: map[string]bool{"zpool": true}},
+			commands: [][]string{{"zfs", "create", "-o", "mountpoint=legacy", "zpool/ROOT/nixos"}},
+			wantErr:  "parent dataset zpool/ROOT would not exist",
+		},
+		{
+			name:     "zfs create the parents",
+			setup:    testSetup{pools: map[string]bool{"zpool": true}},
+			commands: [][]string{{"zfs", "create", "-p", "zpool/ROOT/nixos"}},
+			want:     []string{"pool zpool: imported", "dataset zpool/ROOT/nixos"},
+		},
+		{
+			name:     "zfs create an existing dataset",
+			setup:    testSetup{pools: map[string]bool{"zpool": true}, datasets: []string{"zpool/home"}},
+			commands: [][]string{{"zfs", "create", "zpool/home"}},
+			wantErr:  "dataset zpool/home would already exist",
+		},
+		{
+			name:     "zfs create in an exported pool",
+			setup:    testSetup{pools: map[string]bool{"zpool": false}},
+			commands: [][]string{{"zfs", "create", "zpool/home"}},
+			wantErr:  "pool zpool would not be imported",
+		},
+		{
+			name:     "zfs set",
+			setup:    testSetup{pools: map[string]bool{"zpool": true}, datasets: []string{"zpool/home"}},
+			commands: [][]string{{"zfs", "set", "mountpoint=legacy", "zpool/home"}},
+			want:     []string{"pool zpool: imported", "dataset zpool/home"},
+		},
+		{
+			name:     "zfs set on a missing dataset",
+			setup:    testSetup{pools: map[string]bool{"zpool": true}},
+			commands: [][]string{{"zfs", "set", "mountpoint=legacy", "zpool/home"}},
+			wantErr:  "dataset zpool/home would not exist",
+		},
+		{
+			name:  "mount and umount a dataset",
+			setup: testSetup{pools: map[string]bool{"zpool": true}, datasets: []string{"zpool/root", "zpool/home"}},
+			commands: [][]string{
+				{"mount", "-o", "X-mount.mkdir", "-t", "zfs", "zpool/root", "/mnt"},
+				{"mount", "-o", "X-mount.mkdir", "-t", "zfs", "zpool/home", "/mnt/home"},
+				{"umount", "/mnt/home"},
+			},
+			want: []string{"pool zpool: imported", "dataset zpool/home", "dataset zpool/root", "mount zpool/root on /mnt"},
+		},
+		{
+			name:     "mount a missing dataset",
+			setup:    testSetup{pools: map[string]bool{"zpool": true}},
+			commands: [][]string{{"mount", "-t", "zfs", "zpool/root", "/mnt"}},
+			wantErr:  "dataset zpool/root would not exist",
+		},
+		{
+			name:     "mount over a mount",
+			setup:    testSetup{mounts: map[string]string{"/mnt": "/dev/sdb1"}},
+			commands: [][]string{{"mount", "-t", "xfs", "/dev/sdc1", "/mnt"}},
+			wantErr:  "/mnt would already have /dev/sdb1 mounted",
+		},
+		{
+			name:  "mount a partition",
+			setup: testSetup{disks: map[string][]int{"/dev/sda": {}}},
+			commands: [][]string{
+				append(slices.Clone(parted), "mklabel", "gpt", "mkpart", "ESP", "fat32", "1MiB", "4GiB"),
+				{"mkfs.vfat", "-n", "EFI", "/dev/sda-part1"},
+				{"mount", "-t", "vfat", "-o", "X-mount.mkdir", "/dev/sda-part1", "/mnt/boot"},
+			},
+			want: []string{"disk /dev/sda: part1 (vfat)", "mount /dev/sda-part1 on /mnt/boot"},
+		},
+		{
+			name:  "mount an unformatted partition",
+			setup: testSetup{disks: map[string][]int{"/dev/sda": {}}},
+			commands: [][]string{
+				append(slices.Clone(parted), "mklabel", "gpt", "mkpart", "ESP", "fat32", "1MiB", "4GiB"),
+				{"mount", "-t", "vfat", "/dev/sda-part1", "/mnt/boot"},
+			},
+			wantErr: "/dev/sda-part1 would not be formatted",
+		},
+		{
+			name:  "mount a partition with another file system",
+			setup: testSetup{disks: map[string][]int{"/dev/sda": {}}},
+			commands: [][]string{
+				append(slices.Clone(parted), "mklabel", "gpt", "mkpart", "nixos", "1MiB", "100%"),
+				{"mkfs.ext4", "-L", "nixos", "/dev/sda-part1"},
+				{"mount", "-t", "xfs", "/dev/sda-part1", "/mnt"},
+			},
+			wantErr: "/dev/sda-part1 would be formatted as ext4, not xfs",
+		},
+		{
+			name:     "umount a path that is not mounted",
+			setup:    testSetup{},
+			commands: [][]string{{"umount", "/mnt"}},
+			wantErr:  "/mnt would not be mounted",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.setup.start()
+			defer func() { state = nil }()
+
+			for i, command := range test.commands {
+				err := Apply(command)
+				last := i == len(test.commands)-1
+				if last && test.wantErr != "" {
+					if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+						t.Fatalf("Apply(%v) error = %v, want %q", command, err, test.wantErr)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("Apply(%v) error = %v", command, err)
+				}
+			}
+
+			if got := Summary("/mnt"); !slices.Equal(got, test.want) {
+				t.Errorf("Summary() = %q, want %q", got, test.want)
+			}
+		})
+	}
+
+}
+
+func TestApplyDisabled(t *testing.T) {
+
+	state = nil
+	if err := Apply([]string{"umount", "/mnt"}); err != nil {
+		t.Errorf("Apply() without a simulation error = %v", err)
+	}
+	if Enabled() {
+		t.Error("Enabled() = true without a simulation")
+	}
+
+}
@@ -5,8 +5,11 @@ package utils
 import (
 	"encoding/json"
 	"fmt"
-	"log"
+	"os"
+	"path/filepath"
 	"strings"
+
+	logger "github.com/MAHDTech/nixos-installer/pkg/logger"
 )
 
 // BlockDevice represents the structure of a block device in the JSON.
@@ -52,11 +55,11 @@ func GetMountpoints(deviceID string, data []byte) ([]string, error) {
 
 		// Look for the device ID inside the JSON.
 		if strings.Contains(deviceIDFromJSON, deviceID) {
-			log.Printf("Checking device ID %s for mountpoints", deviceIDFromJSON)
+			logger.Infof("Checking device ID %s for mountpoints", deviceIDFromJSON)
 			if device.Mountpoints != nil {
 				for _, mountpoint := range device.Mountpoints {
 					if mountpoint != "" {
-						log.Printf("Found a mountpoint for %s at %s", deviceIDFromJSON, mountpoint)
+						logger.Infof("Found a mountpoint for %s at %s", deviceIDFromJSON, mountpoint)
 						mountpoints = append(mountpoints, mountpoint)
 					}
 				}
@@ -82,3 +85,45 @@ func UnmountAll(execute bool, mountpoints []string) error {
 	return nil
 
 }
+
+// ProcessesUsing function will return the processes with files open under a mountpoint.
+func ProcessesUsing(mountpoint string) []string {
+
+	processes := []string{}
+
+	procs, err := filepath.Glob("/proc/[0-9]*")
+	if err != nil {
+		return processes
+	}
+
+	for _, proc := range procs {
+
+		// Check the working directory, root and open files of the process.
+		links := []string{
+			filepath.Join(proc, "cwd"),
+			filepath.Join(proc, "root"),
+			filepath.Join(proc, "exe"),
+		}
+		fds, _ := filepath.Glob(filepath.Join(proc, "fd", "*"))
+		links = append(links, fds...)
+
+		for _, link := range links {
+			target, err := os.Readlink(link)
+			if err != nil {
+				continue
+			}
+			if target == mountpoint || strings.HasPrefix(target, mountpoint+"/") {
+				// #nosec G304
+				comm, _ := os.ReadFile(filepath.Join(proc, "comm"))
+				processes = append(
+					processes,
+					fmt.Sprintf("%s (%s)", filepath.Base(proc), strings.TrimSpace(string(comm))),
+				)
+				break
+			}
+		}
+	}
+
+	return processes
+
+}
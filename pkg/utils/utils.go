@@ -2,10 +2,18 @@
 package utils
 
 import (
-	"log"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"strings"
+	"time"
 
+	events "github.com/MAHDTech/nixos-installer/pkg/events"
+	logger "github.com/MAHDTech/nixos-installer/pkg/logger"
+	simulate "github.com/MAHDTech/nixos-installer/pkg/simulate"
 	validate "github.com/MAHDTech/nixos-installer/pkg/validate"
 )
 
@@ -28,6 +36,63 @@ func IsValidBlockDevice(device string) bool {
 
 }
 
+// run function will run the command and record it in the transcript.
+// Stderr is still shown on the console as well as being captured, the captured stderr is returned.
+func run(cmd *exec.Cmd, output func() ([]byte, error)) ([]byte, string, error) {
+
+	var stderr bytes.Buffer
+	if cmd.Stderr != nil {
+		cmd.Stderr = io.MultiWriter(cmd.Stderr, &stderr)
+	} else {
+		cmd.Stderr = &stderr
+	}
+
+	// Stream the output as events, stdout is left alone when it is being captured.
+	if events.Enabled() {
+		stderrEvents := events.OutputWriter(cmd.Args, "stderr")
+		cmd.Stderr = io.MultiWriter(cmd.Stderr, stderrEvents)
+		defer stderrEvents.Flush()
+		if cmd.Stdout != nil {
+			stdoutEvents := events.OutputWriter(cmd.Args, "stdout")
+			cmd.Stdout = io.MultiWriter(cmd.Stdout, stdoutEvents)
+			defer stdoutEvents.Flush()
+		}
+	}
+
+	start := time.Now()
+	stdout, err := output()
+
+	exitCode := 0
+	if err != nil {
+		exitCode = -1
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			exitCode = exitErr.ExitCode()
+		}
+	}
+
+	logger.LogCommand(logger.Command{
+		Argv:       cmd.Args,
+		ExitCode:   exitCode,
+		DurationMS: time.Since(start).Milliseconds(),
+		Stderr:     stderr.String(),
+	})
+
+	return stdout, stderr.String(), err
+
+}
+
+// dryRun function will log the command that would have been run.
+// When the simulation is running, it returns the reason the command would fail.
+func dryRun(cmd *exec.Cmd) error {
+	logger.Infof("DRY RUN: Would run %s", cmd.String())
+	logger.LogCommand(logger.Command{
+		Argv:   cmd.Args,
+		DryRun: true,
+	})
+	return simulate.Apply(cmd.Args)
+}
+
 // Execute function will execute a command and check for errors.
 func Execute(execute bool, cmdName string, args ...string) {
 	cmd := exec.Command(cmdName, args...)
@@ -36,27 +101,55 @@ func Execute(execute bool, cmdName string, args ...string) {
 	cmd.Stdin = os.Stdin
 
 	if execute {
-		validate.Panic(cmd.Run())
-	} else {
-		log.Printf("DRY RUN: Would run %s\n", cmd.String())
+		_, _, err := run(cmd, func() ([]byte, error) { return nil, cmd.Run() })
+		validate.Panic(err)
+	} else if err := dryRun(cmd); err != nil {
+		logger.Warnf("DRY RUN: This command would fail: %s", err)
 	}
 }
 
-// ExecuteSilent function will execute a command and ignore any errors.
-func ExecuteSilent(execute bool, cmdName string, args ...string) {
+// ExecuteSilent function will execute a command and continue on any errors.
+// The error is returned for callers that want to report it.
+func ExecuteSilent(execute bool, cmdName string, args ...string) error {
 	cmd := exec.Command(cmdName, args...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	cmd.Stdin = os.Stdin
 
 	if execute {
-		err := cmd.Run()
+		_, _, err := run(cmd, func() ([]byte, error) { return nil, cmd.Run() })
 		if err != nil {
-			log.Printf("Command failed, but continuing: %s", err)
+			logger.Warnf("Command failed, but continuing: %s", err)
 		}
-	} else {
-		log.Printf("DRY RUN: Would run %s\n", cmd.String())
+		return err
 	}
+
+	// The failure of a silent command is expected, e.g. destroying a pool that may not exist.
+	if err := dryRun(cmd); err != nil {
+		logger.Infof("DRY RUN: This command would fail, but continuing: %s", err)
+	}
+	return nil
+}
+
+// ExecuteEnv function will execute a command with extra environment variables and return any error.
+// The stdout is shown on the console and returned so it can be recorded.
+func ExecuteEnv(execute bool, env []string, cmdName string, args ...string) (string, error) {
+	var stdout bytes.Buffer
+	cmd := exec.Command(cmdName, args...)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = io.MultiWriter(os.Stdout, &stdout)
+	cmd.Stderr = os.Stderr
+	cmd.Stdin = os.Stdin
+
+	if execute {
+		_, _, err := run(cmd, func() ([]byte, error) { return nil, cmd.Run() })
+		return stdout.String(), err
+	}
+
+	if err := dryRun(cmd); err != nil {
+		logger.Warnf("DRY RUN: This command would fail: %s", err)
+	}
+	return "", nil
 }
 
 // ExecuteStdOut function will execute a command and return the stdout.
@@ -65,13 +158,15 @@ func ExecuteStdOut(execute bool, cmdName string, args ...string) string {
 	cmd.Stderr = os.Stderr
 	cmd.Stdin = os.Stdin
 
-	if !execute {
-		output, err := cmd.Output()
+	if execute {
+		output, _, err := run(cmd, cmd.Output)
 		validate.Error(err)
 		return string(output)
 	}
 
-	log.Printf("DRY RUN: Would run %s\n", cmd.String())
+	if err := dryRun(cmd); err != nil {
+		logger.Warnf("DRY RUN: This command would fail: %s", err)
+	}
 	return ""
 
 }
@@ -81,3 +176,30 @@ func FileExists(path string) bool {
 	_, err := os.Stat(path)
 	return !os.IsNotExist(err)
 }
+
+// Query function will execute a read-only command and return the stdout.
+// Queries are always executed, even in dry run mode, as they make no changes.
+// The error includes the stderr of the command.
+func Query(cmdName string, args ...string) (string, error) {
+	cmd := exec.Command(cmdName, args...)
+	cmd.Stdin = os.Stdin
+
+	output, stderr, err := run(cmd, cmd.Output)
+	if err != nil && strings.TrimSpace(stderr) != "" {
+		err = fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr))
+	}
+	return string(output), err
+}
+
+// QueryInput function will execute a read-only command with the input on stdin and return the stdout.
+// The input is not recorded, so it can be used for secrets.
+func QueryInput(input string, cmdName string, args ...string) (string, error) {
+	cmd := exec.Command(cmdName, args...)
+	cmd.Stdin = strings.NewReader(input)
+
+	output, stderr, err := run(cmd, cmd.Output)
+	if err != nil && strings.TrimSpace(stderr) != "" {
+		err = fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr))
+	}
+	return string(output), err
+}
@@ -2,19 +2,19 @@
 package validate
 
 import (
-	"log"
+	logger "github.com/MAHDTech/nixos-installer/pkg/logger"
 )
 
 // Error will log fatal if the error is not nil.
 func Error(err error) {
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatal(err)
 	}
 }
 
 // Panic will panic if the error is not nil.
 func Panic(err error) {
 	if err != nil {
-		log.Panic(err)
+		logger.Panic(err)
 	}
 }